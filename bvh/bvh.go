@@ -0,0 +1,292 @@
+package bvh
+
+import (
+	"github.com/BenLubar/goray/geometry"
+	"math"
+)
+
+const (
+	// Number of buckets used to approximate the surface area heuristic
+	numBins = 16
+	// Nodes with at most this many primitives are never split
+	maxLeafSize = 2
+	// Relative cost of a ray/box test compared to a ray/primitive test
+	traversalCost = 0.5
+	// Hits closer than this are ignored to avoid self intersection
+	minDistance = 1e-15
+)
+
+type primitive struct {
+	shape *geometry.Shape
+	index int
+}
+
+type box struct {
+	min, max geometry.Vec3
+}
+
+func emptyBox() box {
+	inf := math.Inf(+1)
+	return box{geometry.Vec3{inf, inf, inf}, geometry.Vec3{-inf, -inf, -inf}}
+}
+
+func (b *box) extend(min, max geometry.Vec3) {
+	b.min.X, b.min.Y, b.min.Z = math.Min(b.min.X, min.X), math.Min(b.min.Y, min.Y), math.Min(b.min.Z, min.Z)
+	b.max.X, b.max.Y, b.max.Z = math.Max(b.max.X, max.X), math.Max(b.max.Y, max.Y), math.Max(b.max.Z, max.Z)
+}
+
+func (b box) area() float64 {
+	d := b.max.Sub(b.min)
+	if d.X < 0 || d.Y < 0 || d.Z < 0 {
+		return 0
+	}
+	return 2 * (d.X*d.Y + d.Y*d.Z + d.Z*d.X)
+}
+
+func axis(v geometry.Vec3, dimension int) float64 {
+	switch dimension {
+	case 0:
+		return v.X
+	case 1:
+		return v.Y
+	}
+	return v.Z
+}
+
+// Nodes are stored depth first in one slice. The first child of an
+// interior node directly follows it, offset is the index of the second
+// child. For leaves offset is the first primitive and count > 0.
+type node struct {
+	bounds        box
+	offset, count int
+	axis          int
+}
+
+// A bounding volume hierarchy over the primitives of a scene. Shapes
+// without finite bounds (planes) are kept in a separate list and tested
+// against every ray.
+type BVH struct {
+	nodes      []node
+	primitives []primitive
+	unbounded  []*geometry.Shape
+}
+
+type buildItem struct {
+	bounds   box
+	centroid geometry.Vec3
+	prim     primitive
+}
+
+// Builds a BVH over every primitive of the shapes, splitting nodes where
+// the surface area heuristic predicts the cheapest traversal. Moving shapes
+// are bounded over the shutter time in seconds.
+func New(shapes []*geometry.Shape, shutter float64) *BVH {
+	tree := &BVH{}
+	var items []buildItem
+	for _, shape := range shapes {
+		for i := 0; i < shape.Primitives(); i++ {
+			min, max, bounded := shape.MovingBounds(i, shutter)
+			if !bounded {
+				tree.unbounded = append(tree.unbounded, shape)
+				break
+			}
+			items = append(items, buildItem{
+				box{min, max},
+				min.Add(max).Mult(0.5),
+				primitive{shape, i},
+			})
+		}
+	}
+	if len(items) > 0 {
+		tree.build(items)
+	}
+	return tree
+}
+
+func (tree *BVH) build(items []buildItem) int {
+	index := len(tree.nodes)
+	tree.nodes = append(tree.nodes, node{})
+
+	bounds, centroids := emptyBox(), emptyBox()
+	for _, item := range items {
+		bounds.extend(item.bounds.min, item.bounds.max)
+		centroids.extend(item.centroid, item.centroid)
+	}
+
+	split, dimension := -1, 0
+	if len(items) > maxLeafSize {
+		split, dimension = findSplit(items, bounds, centroids)
+	}
+
+	if split < 0 {
+		tree.nodes[index] = node{bounds, len(tree.primitives), len(items), 0}
+		for _, item := range items {
+			tree.primitives = append(tree.primitives, item.prim)
+		}
+		return index
+	}
+
+	tree.build(items[:split])
+	second := tree.build(items[split:])
+	tree.nodes[index] = node{bounds, second, 0, dimension}
+	return index
+}
+
+// Evaluates the surface area heuristic for bucketed split positions along
+// every axis and partitions items around the best one. Returns -1 if
+// creating a leaf is cheaper than any split.
+func findSplit(items []buildItem, bounds, centroids box) (int, int) {
+	type bin struct {
+		bounds box
+		count  int
+	}
+
+	bestCost := float64(len(items))
+	bestDim, bestBin := -1, 0
+	parentArea := bounds.area()
+
+	for dimension := 0; dimension < 3; dimension++ {
+		low := axis(centroids.min, dimension)
+		extent := axis(centroids.max, dimension) - low
+		if extent <= 0 {
+			continue
+		}
+
+		var bins [numBins]bin
+		for i := range bins {
+			bins[i].bounds = emptyBox()
+		}
+		for _, item := range items {
+			b := binIndex(axis(item.centroid, dimension), low, extent)
+			bins[b].count++
+			bins[b].bounds.extend(item.bounds.min, item.bounds.max)
+		}
+
+		// Sweep from the right to find the cost of every right half.
+		var rightArea [numBins]float64
+		var rightCount [numBins]int
+		right := emptyBox()
+		count := 0
+		for i := numBins - 1; i > 0; i-- {
+			right.extend(bins[i].bounds.min, bins[i].bounds.max)
+			count += bins[i].count
+			rightArea[i], rightCount[i] = right.area(), count
+		}
+
+		left := emptyBox()
+		count = 0
+		for i := 0; i < numBins-1; i++ {
+			left.extend(bins[i].bounds.min, bins[i].bounds.max)
+			count += bins[i].count
+			if count == 0 || rightCount[i+1] == 0 {
+				continue
+			}
+			cost := traversalCost + (left.area()*float64(count)+rightArea[i+1]*float64(rightCount[i+1]))/parentArea
+			if cost < bestCost {
+				bestCost, bestDim, bestBin = cost, dimension, i
+			}
+		}
+	}
+
+	if bestDim < 0 {
+		return -1, 0
+	}
+
+	low := axis(centroids.min, bestDim)
+	extent := axis(centroids.max, bestDim) - low
+	i, j := 0, len(items)-1
+	for i <= j {
+		if binIndex(axis(items[i].centroid, bestDim), low, extent) <= bestBin {
+			i++
+		} else {
+			items[i], items[j] = items[j], items[i]
+			j--
+		}
+	}
+	return i, bestDim
+}
+
+func binIndex(value, low, extent float64) int {
+	b := int(numBins * (value - low) / extent)
+	if b >= numBins {
+		b = numBins - 1
+	}
+	return b
+}
+
+// Slab test of the ray against the box. Returns whether the box is hit
+// closer than maxDist.
+func (b *box) hit(origin, inverse geometry.Vec3, maxDist float64) bool {
+	t1, t2 := (b.min.X-origin.X)*inverse.X, (b.max.X-origin.X)*inverse.X
+	near, far := math.Min(t1, t2), math.Max(t1, t2)
+
+	t1, t2 = (b.min.Y-origin.Y)*inverse.Y, (b.max.Y-origin.Y)*inverse.Y
+	near, far = math.Max(near, math.Min(t1, t2)), math.Min(far, math.Max(t1, t2))
+
+	t1, t2 = (b.min.Z-origin.Z)*inverse.Z, (b.max.Z-origin.Z)*inverse.Z
+	near, far = math.Max(near, math.Min(t1, t2)), math.Min(far, math.Max(t1, t2))
+
+	return near <= far && far > 0 && near < maxDist
+}
+
+// Finds the closest shape hit by the ray. Also returns the primitive of
+// the shape that was hit, for use with Shape.PrimitiveNormal, and the
+// distance along the ray. The shape is nil if nothing was hit.
+func (tree *BVH) ClosestIntersection(ray geometry.Ray) (*geometry.Shape, int, float64) {
+	var closest *geometry.Shape
+	closestIndex := 0
+	bestHit := math.Inf(+1)
+
+	for _, shape := range tree.unbounded {
+		if hit := shape.Intersects(ray); hit > minDistance && hit < bestHit {
+			bestHit = hit
+			closest = shape
+		}
+	}
+
+	if len(tree.nodes) == 0 {
+		return closest, closestIndex, bestHit
+	}
+
+	inverse := geometry.Vec3{1 / ray.Direction.X, 1 / ray.Direction.Y, 1 / ray.Direction.Z}
+	negative := [3]bool{inverse.X < 0, inverse.Y < 0, inverse.Z < 0}
+
+	var buffer [64]int
+	stack := append(buffer[:0], 0)
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n := &tree.nodes[current]
+		if !n.bounds.hit(ray.Origin, inverse, bestHit) {
+			continue
+		}
+
+		if n.count > 0 {
+			for _, p := range tree.primitives[n.offset : n.offset+n.count] {
+				if hit := p.shape.PrimitiveIntersects(p.index, ray); hit > minDistance && hit < bestHit {
+					bestHit = hit
+					closest, closestIndex = p.shape, p.index
+				}
+			}
+			continue
+		}
+
+		// Visit the nearer child first so the further one is more
+		// likely to be culled.
+		first, second := current+1, n.offset
+		if negative[n.axis] {
+			first, second = second, first
+		}
+		stack = append(stack, second, first)
+	}
+
+	return closest, closestIndex, bestHit
+}
+
+// The box around every bounded primitive. ok is false if there are none.
+func (tree *BVH) Bounds() (min, max geometry.Vec3, ok bool) {
+	if len(tree.nodes) == 0 {
+		return geometry.Vec3{}, geometry.Vec3{}, false
+	}
+	return tree.nodes[0].bounds.min, tree.nodes[0].bounds.max, true
+}
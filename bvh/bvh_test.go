@@ -0,0 +1,133 @@
+package bvh
+
+import (
+	"github.com/BenLubar/goray/geometry"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// The closest shape hit by ray, testing every shape of the scene.
+func linearScan(shapes []*geometry.Shape, ray geometry.Ray) (*geometry.Shape, float64) {
+	var closest *geometry.Shape
+	bestHit := math.Inf(+1)
+	for _, shape := range shapes {
+		if hit := shape.Intersects(ray); hit > minDistance && hit < bestHit {
+			bestHit = hit
+			closest = shape
+		}
+	}
+	return closest, bestHit
+}
+
+func randomVec(r *rand.Rand, scale float64) geometry.Vec3 {
+	return geometry.Vec3{r.Float64()*2 - 1, r.Float64()*2 - 1, r.Float64()*2 - 1}.Mult(scale)
+}
+
+func randomDirection(r *rand.Rand) geometry.Vec3 {
+	for {
+		if v := randomVec(r, 1); v.Abs() > 0.1 && v.Abs() <= 1 {
+			return v.Normalize()
+		}
+	}
+}
+
+// A mesh of count random triangles around position.
+func randomMesh(r *rand.Rand, position geometry.Vec3, count int) *geometry.Shape {
+	var vertices []geometry.Vec3
+	var faces [][3]int
+	for i := 0; i < count; i++ {
+		center := randomVec(r, 2)
+		for j := 0; j < 3; j++ {
+			vertices = append(vertices, center.Add(randomVec(r, 0.5)))
+		}
+		faces = append(faces, [3]int{3 * i, 3*i + 1, 3*i + 2})
+	}
+	return geometry.Mesh(position, vertices, nil, faces, geometry.Vec3{}, geometry.Vec3{1, 1, 1}, geometry.DIFFUSE)
+}
+
+func randomScene(r *rand.Rand, planes bool) []*geometry.Shape {
+	var shapes []*geometry.Shape
+	white := geometry.Vec3{1, 1, 1}
+	for i := 0; i < 40; i++ {
+		shapes = append(shapes, geometry.Sphere(0.1+r.Float64(), randomVec(r, 10), geometry.Vec3{}, white, geometry.DIFFUSE))
+	}
+	for i := 0; i < 10; i++ {
+		shapes = append(shapes, geometry.Cube(0.1+r.Float64(), randomVec(r, 10), geometry.Vec3{}, white, geometry.DIFFUSE))
+	}
+	for i := 0; i < 3; i++ {
+		shapes = append(shapes, randomMesh(r, randomVec(r, 10), 50))
+	}
+	if planes {
+		shapes = append(shapes,
+			geometry.Plane(geometry.Vec3{0, -12, 0}, geometry.Vec3{}, white, geometry.Vec3{0, 1, 0}, geometry.DIFFUSE),
+			geometry.Plane(geometry.Vec3{12, 0, 0}, geometry.Vec3{}, white, randomDirection(r), geometry.DIFFUSE))
+	}
+	return shapes
+}
+
+// Compares the hit of the tree to the linear scan. The primitive returned
+// for a mesh must be the face that was hit.
+func checkRay(t *testing.T, tree *BVH, shapes []*geometry.Shape, ray geometry.Ray) bool {
+	t.Helper()
+	shape, index, distance := tree.ClosestIntersection(ray)
+	want, wantDistance := linearScan(shapes, ray)
+	if shape != want || distance != wantDistance {
+		t.Fatalf("ray %v hits %v at %v, want %v at %v", ray, shape, distance, want, wantDistance)
+	}
+	if shape != nil && shape.PrimitiveIntersects(index, ray) != distance {
+		t.Fatalf("ray %v hits primitive %d of %v at %v, not %v", ray, index, shape, shape.PrimitiveIntersects(index, ray), distance)
+	}
+	return shape != nil
+}
+
+func TestClosestIntersection(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, planes := range []bool{false, true} {
+		shapes := randomScene(r, planes)
+		tree := New(shapes, 0)
+
+		hits, misses := 0, 0
+		for i := 0; i < 20000; i++ {
+			ray := geometry.Ray{randomVec(r, 15), randomDirection(r), 0}
+			if checkRay(t, tree, shapes, ray) {
+				hits++
+			} else {
+				misses++
+			}
+		}
+		if hits == 0 || (!planes && misses == 0) {
+			t.Errorf("%d hits and %d misses", hits, misses)
+		}
+
+		// Rays leaving the inside of every sphere and cube, the only
+		// shapes with a radius
+		for _, shape := range shapes {
+			if shape.Radius > 0 {
+				for i := 0; i < 20; i++ {
+					ray := geometry.Ray{shape.Position.Add(randomVec(r, shape.Radius/2)), randomDirection(r), 0}
+					if !checkRay(t, tree, shapes, ray) {
+						t.Fatalf("ray %v from inside %v misses", ray, shape)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Scenes of only planes have no nodes at all.
+func TestClosestIntersectionPlanes(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	white := geometry.Vec3{1, 1, 1}
+	shapes := []*geometry.Shape{
+		geometry.Plane(geometry.Vec3{0, -1, 0}, geometry.Vec3{}, white, geometry.Vec3{0, 1, 0}, geometry.DIFFUSE),
+		geometry.Plane(geometry.Vec3{0, 1, 0}, geometry.Vec3{}, white, geometry.Vec3{0, -1, 0}, geometry.DIFFUSE),
+	}
+	tree := New(shapes, 0)
+	if _, _, ok := tree.Bounds(); ok {
+		t.Error("planes have bounds")
+	}
+	for i := 0; i < 1000; i++ {
+		checkRay(t, tree, shapes, geometry.Ray{randomVec(r, 0.9), randomDirection(r), 0})
+	}
+}
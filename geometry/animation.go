@@ -0,0 +1,305 @@
+package geometry
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+var ErrInterpolation = errors.New("invalid interpolation")
+var ErrAnimatedObject = errors.New("animated object does not exist")
+
+// How a value changes between a keyframe and the next one.
+type Interpolation int
+
+const (
+	LINEAR Interpolation = iota
+	// Follows a cubic Bezier curve set by the handles of both keyframes
+	BEZIER
+	// Smooth curve through all keyframes of the value
+	CATMULL_ROM
+)
+
+var interpolations = map[string]Interpolation{
+	"\"LINEAR\"":      LINEAR,
+	"\"BEZIER\"":      BEZIER,
+	"\"CATMULL_ROM\"": CATMULL_ROM,
+}
+var interpolationsReverse = map[Interpolation]string{
+	LINEAR:      "\"LINEAR\"",
+	BEZIER:      "\"BEZIER\"",
+	CATMULL_ROM: "\"CATMULL_ROM\"",
+}
+
+func (t *Interpolation) MarshalJSON() ([]byte, error) {
+	return []byte(interpolationsReverse[*t]), nil
+}
+
+func (t *Interpolation) UnmarshalJSON(b []byte) error {
+	v, ok := interpolations[string(b)]
+	if !ok {
+		return ErrInterpolation
+	}
+	*t = v
+	return nil
+}
+
+// A keyframe sets any of its non-nil values at Time, in seconds. Every
+// value is interpolated separately between the keyframes that set it.
+type Keyframe struct {
+	Time          float64
+	Interpolation Interpolation
+
+	// Camera keyframes. Camera is the position of the camera.
+	Pitch, Yaw, Roll *float64
+	Camera, LookAt   *Vec3
+	FocusDistance    *float64
+
+	// Object keyframes
+	Position, Color, Emission *Vec3
+
+	// Bezier interpolation leaves a keyframe along its Out handle and
+	// reaches the next one along the In handle of that one. Handles are
+	// (time, progress) points relative to the two keyframes, with the time
+	// clamped between 0 and 1. Out defaults to [1/3, 0] and In to [2/3, 1],
+	// easing in and out of both keyframes.
+	Out, In *[2]float64
+}
+
+var (
+	defaultOut = [2]float64{1.0 / 3, 0}
+	defaultIn  = [2]float64{2.0 / 3, 1}
+)
+
+// The progress at time s between two keyframes, both from 0 to 1, along
+// the cubic Bezier curve from (0, 0) to (1, 1) with the handles out and in.
+func bezier(s float64, out, in [2]float64) float64 {
+	cubic := func(u, p1, p2 float64) float64 {
+		v := 1 - u
+		return 3*v*v*u*p1 + 3*v*u*u*p2 + u*u*u
+	}
+	// The time only grows along the curve, so the point at time s can be
+	// found by bisection.
+	x1, x2 := math.Min(math.Max(out[0], 0), 1), math.Min(math.Max(in[0], 0), 1)
+	low, high := 0.0, 1.0
+	for i := 0; i < 52; i++ {
+		if u := (low + high) / 2; cubic(u, x1, x2) < s {
+			low = u
+		} else {
+			high = u
+		}
+	}
+	return cubic((low+high)/2, out[1], in[1])
+}
+
+// The timeline of a scene. Objects is keyed by the index of the entry in
+// the scene file's Objects list.
+type Animation struct {
+	Camera  []Keyframe
+	Objects map[int][]Keyframe
+}
+
+// The time of the last keyframe, or zero for a still image.
+func (a *Animation) Duration() float64 {
+	var duration float64
+	for _, k := range a.Camera {
+		if k.Time > duration {
+			duration = k.Time
+		}
+	}
+	for _, keys := range a.Objects {
+		for _, k := range keys {
+			if k.Time > duration {
+				duration = k.Time
+			}
+		}
+	}
+	return duration
+}
+
+func sortKeyframes(keys []Keyframe) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].Time < keys[j].Time
+	})
+}
+
+// Sorts the keyframes and checks that every animated object exists.
+// entries is the number of objects in the scene file.
+func (a *Animation) validate(entries int) SceneErrors {
+	var errs SceneErrors
+	sortKeyframes(a.Camera)
+	for i, keys := range a.Objects {
+		if i < 0 || i >= entries {
+			errs = append(errs, &ObjectError{"object", i, "Animation", "", ErrAnimatedObject})
+			continue
+		}
+		sortKeyframes(keys)
+	}
+	return errs
+}
+
+// Evaluates one value of the timeline at time t. get returns the value
+// set by a keyframe, if any. ok is false if no keyframe sets the value.
+func evaluate(keys []Keyframe, t float64, get func(*Keyframe) (Vec3, bool)) (v Vec3, ok bool) {
+	var times []float64
+	var values []Vec3
+	var modes []Interpolation
+	var outs, ins [][2]float64
+	for i := range keys {
+		if value, ok := get(&keys[i]); ok {
+			times = append(times, keys[i].Time)
+			values = append(values, value)
+			modes = append(modes, keys[i].Interpolation)
+			out, in := defaultOut, defaultIn
+			if keys[i].Out != nil {
+				out = *keys[i].Out
+			}
+			if keys[i].In != nil {
+				in = *keys[i].In
+			}
+			outs, ins = append(outs, out), append(ins, in)
+		}
+	}
+
+	n := len(values)
+	switch {
+	case n == 0:
+		return Vec3{}, false
+	case t <= times[0]:
+		return values[0], true
+	case t >= times[n-1]:
+		return values[n-1], true
+	}
+
+	i := sort.SearchFloat64s(times, t)
+	if times[i] == t {
+		return values[i], true
+	}
+	i--
+	s := (t - times[i]) / (times[i+1] - times[i])
+
+	switch modes[i] {
+	case BEZIER:
+		s = bezier(s, outs[i], ins[i+1])
+	case CATMULL_ROM:
+		p0, p1, p2, p3 := values[i], values[i], values[i+1], values[i+1]
+		if i > 0 {
+			p0 = values[i-1]
+		}
+		if i+2 < n {
+			p3 = values[i+2]
+		}
+		s2, s3 := s*s, s*s*s
+		return p1.Mult(2).
+			Add(p2.Sub(p0).Mult(s)).
+			Add(p0.Mult(2).Sub(p1.Mult(5)).Add(p2.Mult(4)).Sub(p3).Mult(s2)).
+			Add(p1.Mult(3).Sub(p0).Sub(p2.Mult(3)).Add(p3).Mult(s3)).
+			Mult(0.5), true
+	}
+	return values[i].Add(values[i+1].Sub(values[i]).Mult(s)), true
+}
+
+func vectorKey(field func(*Keyframe) *Vec3) func(*Keyframe) (Vec3, bool) {
+	return func(k *Keyframe) (Vec3, bool) {
+		if v := field(k); v != nil {
+			return *v, true
+		}
+		return Vec3{}, false
+	}
+}
+
+func scalarKey(field func(*Keyframe) *float64) func(*Keyframe) (Vec3, bool) {
+	return func(k *Keyframe) (Vec3, bool) {
+		if v := field(k); v != nil {
+			return Vec3{*v, 0, 0}, true
+		}
+		return Vec3{}, false
+	}
+}
+
+// Returns the scene of the frame at time t, as it is when the shutter
+// opens. The camera and shapes with a Velocity have moved by it since the
+// start of the animation. The camera and animated shapes also get the
+// velocity that moves them to where they are when the shutter closes, so
+// that they blur along the way.
+func (s Scene) Frame(t float64) Scene {
+	open := t + s.Camera.ShutterOpen
+	frame := s.At(open)
+	shutter := s.Camera.Shutter()
+	if shutter > 0 && s.Animation.Duration() > 0 {
+		end := s.At(t + s.Camera.ShutterClose)
+		frame.Camera.Velocity = frame.Camera.Velocity.Add(end.Camera.Position.Sub(frame.Camera.Position).Mult(1 / shutter))
+		for i, shape := range frame.Objects {
+			// Only animated shapes are copies
+			if shape != s.Objects[i] {
+				shape.Velocity = shape.Velocity.Add(end.Objects[i].Position.Sub(shape.Position).Mult(1 / shutter))
+			}
+		}
+	}
+
+	frame.Camera.Position = frame.Camera.Position.Add(s.Camera.Velocity.Mult(open))
+	copied := len(s.Animation.Objects) != 0
+	for i, shape := range frame.Objects {
+		velocity := s.Objects[i].Velocity
+		if velocity.IsZero() {
+			continue
+		}
+		if !copied {
+			frame.Objects = append([]*Shape(nil), frame.Objects...)
+			copied = true
+		}
+		if shape == s.Objects[i] {
+			moved := *shape
+			shape = &moved
+			frame.Objects[i] = shape
+		}
+		shape.Position = shape.Position.Add(velocity.Mult(open))
+	}
+	return frame
+}
+
+// Returns the scene as it is at time t of its animation. Animated shapes
+// are copied, so the returned scene can be rendered while s is animated
+// to another time.
+func (s Scene) At(t float64) Scene {
+	if v, ok := evaluate(s.Animation.Camera, t, vectorKey(func(k *Keyframe) *Vec3 { return k.Camera })); ok {
+		s.Camera.Position = v
+	}
+	if v, ok := evaluate(s.Animation.Camera, t, vectorKey(func(k *Keyframe) *Vec3 { return k.LookAt })); ok {
+		s.Camera.LookAt = &v
+	}
+	if v, ok := evaluate(s.Animation.Camera, t, scalarKey(func(k *Keyframe) *float64 { return k.FocusDistance })); ok {
+		s.Camera.FocusDistance = v.X
+	}
+	if v, ok := evaluate(s.Animation.Camera, t, scalarKey(func(k *Keyframe) *float64 { return k.Pitch })); ok {
+		s.Pitch = v.X
+	}
+	if v, ok := evaluate(s.Animation.Camera, t, scalarKey(func(k *Keyframe) *float64 { return k.Yaw })); ok {
+		s.Yaw = v.X
+	}
+	if v, ok := evaluate(s.Animation.Camera, t, scalarKey(func(k *Keyframe) *float64 { return k.Roll })); ok {
+		s.Roll = v.X
+	}
+
+	if len(s.Animation.Objects) == 0 {
+		return s
+	}
+
+	s.Objects = append([]*Shape(nil), s.Objects...)
+	for entry, keys := range s.Animation.Objects {
+		for _, i := range s.entries[entry] {
+			shape := *s.Objects[i]
+			if v, ok := evaluate(keys, t, vectorKey(func(k *Keyframe) *Vec3 { return k.Position })); ok {
+				shape.Position = v
+			}
+			if v, ok := evaluate(keys, t, vectorKey(func(k *Keyframe) *Vec3 { return k.Color })); ok {
+				shape.Color = v
+			}
+			if v, ok := evaluate(keys, t, vectorKey(func(k *Keyframe) *Vec3 { return k.Emission })); ok {
+				shape.Emission = v
+			}
+			s.Objects[i] = &shape
+		}
+	}
+	return s
+}
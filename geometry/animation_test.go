@@ -0,0 +1,99 @@
+package geometry
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+const movingScene = `{
+	"Objects": [{
+		"Type":     "SPHERE",
+		"Material": "DIFFUSE",
+		"Position": [0, 0, 0],
+		"Color":    [1, 1, 1],
+		"Radius":   1,
+		"Velocity": [1, 0, 0]
+	}, {
+		"Type":     "SPHERE",
+		"Material": "DIFFUSE",
+		"Position": [0, 5, 0],
+		"Color":    [1, 1, 1],
+		"Radius":   1
+	}],
+	"Camera": {
+		"Position":     [0, 0, -10],
+		"Velocity":     [0, 0, 2],
+		"ShutterClose": 0.01
+	}
+}`
+
+func TestFrameMovesByVelocity(t *testing.T) {
+	scene, err := ReadScene(strings.NewReader(movingScene), ".", 2, 2, 1, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := scene.Frame(0), scene.Frame(0.5)
+	if first.Objects[0].Position != (Vec3{0, 0, 0}) || second.Objects[0].Position != (Vec3{0.5, 0, 0}) {
+		t.Errorf("moving shape is at %v and %v", first.Objects[0].Position, second.Objects[0].Position)
+	}
+	if first.Camera.Position != (Vec3{0, 0, -10}) || second.Camera.Position != (Vec3{0, 0, -9}) {
+		t.Errorf("moving camera is at %v and %v", first.Camera.Position, second.Camera.Position)
+	}
+	if second.Objects[1] != scene.Objects[1] {
+		t.Errorf("still shape was copied")
+	}
+	if scene.Objects[0].Position != (Vec3{0, 0, 0}) || scene.Camera.Position != (Vec3{0, 0, -10}) {
+		t.Errorf("frame changed the scene")
+	}
+}
+
+func TestBezier(t *testing.T) {
+	for _, test := range []struct {
+		out, in [2]float64
+		s, want float64
+	}{
+		// The default handles ease in and out like smoothstep
+		{defaultOut, defaultIn, 0.25, 0.15625},
+		{defaultOut, defaultIn, 0.5, 0.5},
+		// Handles on the diagonal are linear
+		{[2]float64{1.0 / 3, 1.0 / 3}, [2]float64{2.0 / 3, 2.0 / 3}, 0.3, 0.3},
+		// Only easing out of the first keyframe
+		{[2]float64{0.5, 0}, [2]float64{0.5, 1}, 0.5, 0.5},
+		{[2]float64{1, 0}, [2]float64{1, 1}, 1, 1},
+		// Handles above 1 overshoot
+		{[2]float64{0.25, 2}, [2]float64{0.75, 1}, 0.5, 1.25},
+	} {
+		if got := bezier(test.s, test.out, test.in); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("bezier(%v, %v, %v) = %v, want %v", test.s, test.out, test.in, got, test.want)
+		}
+	}
+}
+
+const bezierScene = `{
+	"Objects": [{
+		"Type":     "SPHERE",
+		"Material": "DIFFUSE",
+		"Position": [0, 0, 0],
+		"Color":    [1, 1, 1],
+		"Radius":   1
+	}],
+	"Camera": [0, 0, -10],
+	"Animation": {
+		"Objects": {"0": [
+			{"Time": 0, "Interpolation": "BEZIER", "Position": [0, 0, 0], "Out": [0.25, 2]},
+			{"Time": 2, "Position": [4, 0, 0], "In": [0.75, 1]}
+		]}
+	}
+}`
+
+func TestBezierKeyframes(t *testing.T) {
+	scene, err := ReadScene(strings.NewReader(bezierScene), ".", 2, 2, 1, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scene.Frame(1).Objects[0].Position; math.Abs(got.X-5) > 1e-9 {
+		t.Errorf("shape is at %v halfway, want 5", got)
+	}
+}
@@ -0,0 +1,87 @@
+package geometry
+
+import (
+	"math"
+)
+
+// Acceleration structures work on primitives instead of whole shapes so
+// that the faces of a mesh can be split up. Every shape except a mesh is
+// a single primitive.
+func (s *Shape) Primitives() int {
+	if s.Type == kindMesh {
+		return len(s.Faces)
+	}
+	return 1
+}
+
+// Returns the axis aligned bounding box of the i-th primitive of the
+// shape. Planes have no finite bounds and report bounded as false.
+func (s *Shape) PrimitiveBounds(i int) (min, max Vec3, bounded bool) {
+	switch s.Type {
+	case kindSphere, kindCube:
+		r := Vec3{s.Radius, s.Radius, s.Radius}
+		return s.Position.Sub(r), s.Position.Add(r), true
+	case kindTriangle, kindMesh:
+		a, b, c := s.face(i)
+		min = Vec3{
+			math.Min(a.X, math.Min(b.X, c.X)),
+			math.Min(a.Y, math.Min(b.Y, c.Y)),
+			math.Min(a.Z, math.Min(b.Z, c.Z)),
+		}
+		max = Vec3{
+			math.Max(a.X, math.Max(b.X, c.X)),
+			math.Max(a.Y, math.Max(b.Y, c.Y)),
+			math.Max(a.Z, math.Max(b.Z, c.Z)),
+		}
+		return min.Add(s.Position), max.Add(s.Position), true
+	}
+	return Vec3{}, Vec3{}, false
+}
+
+// Like PrimitiveBounds, for the space the primitive moves through over
+// the first duration seconds after the shutter opened.
+func (s *Shape) MovingBounds(i int, duration float64) (min, max Vec3, bounded bool) {
+	min, max, bounded = s.PrimitiveBounds(i)
+	if bounded && !s.Velocity.IsZero() {
+		offset := s.Offset(duration)
+		min = Vec3{math.Min(min.X, min.X+offset.X), math.Min(min.Y, min.Y+offset.Y), math.Min(min.Z, min.Z+offset.Z)}
+		max = Vec3{math.Max(max.X, max.X+offset.X), math.Max(max.Y, max.Y+offset.Y), math.Max(max.Z, max.Z+offset.Z)}
+	}
+	return min, max, bounded
+}
+
+// How far the shape has moved at time t.
+func (s *Shape) Offset(t float64) Vec3 {
+	return s.Velocity.Mult(t)
+}
+
+// The ray relative to the shape as it is at Position, so that a moving
+// shape can be intersected where it is at the time of the ray.
+func (s *Shape) moving(ray Ray) Ray {
+	if ray.Time != 0 && !s.Velocity.IsZero() {
+		ray.Origin = ray.Origin.Sub(s.Offset(ray.Time))
+	}
+	return ray
+}
+
+func (s *Shape) PrimitiveIntersects(i int, ray Ray) float64 {
+	if s.Type != kindMesh {
+		return s.Intersects(ray)
+	}
+	ray = s.moving(ray)
+	ray.Origin = ray.Origin.Sub(s.Position)
+	a, b, c := s.face(i)
+	dist, _, _ := intersectTriangle(a, b, c, ray)
+	return dist
+}
+
+// Like NormalDir, but for a point known to lie on the i-th primitive,
+// which avoids searching every face of a mesh.
+func (s *Shape) PrimitiveNormal(i int, point Vec3) Vec3 {
+	if s.Type != kindMesh {
+		return s.NormalDir(point)
+	}
+	a, b, c := s.face(i)
+	u, v := barycentric(a, b, c, point.Sub(s.Position))
+	return s.faceNormal(i, u, v)
+}
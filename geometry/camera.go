@@ -0,0 +1,288 @@
+package geometry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrFOV = errors.New("field of view must be between 0 and 180 degrees")
+var ErrFocalLength = errors.New("focal length must be positive")
+var ErrAperture = errors.New("aperture must not be negative")
+var ErrBlades = errors.New("a polygonal aperture needs at least 3 blades")
+var ErrFocusDistance = errors.New("focus distance must be positive")
+var ErrLookAt = errors.New("look at point must differ from the position")
+var ErrUp = errors.New("up must not be parallel to the view direction")
+var ErrProjection = errors.New("invalid projection")
+var ErrViewWidth = errors.New("view width must be positive")
+var ErrFisheyeAngle = errors.New("fisheye angle must be between 0 and 360 degrees")
+var ErrStereo = errors.New("invalid stereo layout")
+var ErrIPD = errors.New("interpupillary distance must not be negative")
+var ErrConvergence = errors.New("convergence distance must not be negative")
+var ErrShutter = errors.New("shutter must not close before it opens")
+
+// The camera a scene is seen from. A camera given as just a position in
+// the scene file is a pinhole camera rotated by the Pitch, Yaw and Roll of
+// the scene.
+//
+// If LookAt is set the camera faces it instead, with Up (the Y axis if
+// zero) pointing up in the image. FOV is the vertical field of view in
+// degrees and FocalLength that of a lens in millimetres, in front of film
+// 24 millimetres high like 35mm film. If neither is set the field of view
+// passed to ReadScene is used.
+//
+// A thin lens with an Aperture radius greater than zero keeps only the
+// plane FocusDistance in front of the camera sharp, which defaults to the
+// distance to LookAt. The aperture is round, or a polygon with Blades
+// corners for polygonal bokeh. Only perspective cameras have a lens.
+//
+// Projection selects how the image maps to directions, see the projection
+// constants. Orthographic cameras see ViewWidth across and fisheye cameras
+// Angle degrees across their image circle, 180 if zero.
+//
+// Stereo cameras render an image for each eye into one output, see the
+// stereo layout constants. The eyes are IPD apart, 0.065 (in metres) if
+// zero, along the right direction of the camera, or around its position
+// for fisheye, equirectangular and cubemap cameras. Their views meet at the Convergence
+// distance, and stay parallel if it is zero.
+//
+// The shutter is open from ShutterOpen to ShutterClose seconds after the
+// time of each frame, blurring whatever moves in between. The camera moves
+// by Velocity every second from its Position when the animation starts.
+// Photons are traced as the scene is when the shutter opens, so caustics
+// and photon mapped light do not blur.
+type Camera struct {
+	Position      Vec3
+	LookAt        *Vec3
+	Up            Vec3
+	FOV           float64
+	FocalLength   float64
+	Aperture      float64
+	Blades        int
+	FocusDistance float64
+	Projection    Projection
+	ViewWidth     float64
+	Angle         float64
+	Stereo        StereoLayout
+	IPD           float64
+	Convergence   float64
+	ShutterOpen   float64
+	ShutterClose  float64
+	Velocity      Vec3
+}
+
+type Projection int
+
+const (
+	// Through an image plane in front of the camera
+	PERSPECTIVE Projection = iota
+	// Parallel rays along the view direction
+	ORTHOGRAPHIC
+	// Equidistant fisheye, the angle to the view direction grows evenly
+	// towards the edge of a circle touching the shorter image sides
+	FISHEYE
+	// Longitude across and latitude up the image, all around the camera
+	EQUIRECTANGULAR
+	// Six square 90 degree faces in a 3 by 2 grid: right, left and up on
+	// the top row, down, front and back on the bottom row, which are square
+	// in a 3:2 image
+	CUBEMAP
+)
+
+var projections = map[string]Projection{
+	"\"PERSPECTIVE\"":     PERSPECTIVE,
+	"\"ORTHOGRAPHIC\"":    ORTHOGRAPHIC,
+	"\"FISHEYE\"":         FISHEYE,
+	"\"EQUIRECTANGULAR\"": EQUIRECTANGULAR,
+	"\"CUBEMAP\"":         CUBEMAP,
+}
+var projectionsReverse = map[Projection]string{
+	PERSPECTIVE:     "\"PERSPECTIVE\"",
+	ORTHOGRAPHIC:    "\"ORTHOGRAPHIC\"",
+	FISHEYE:         "\"FISHEYE\"",
+	EQUIRECTANGULAR: "\"EQUIRECTANGULAR\"",
+	CUBEMAP:         "\"CUBEMAP\"",
+}
+
+func (t *Projection) MarshalJSON() ([]byte, error) {
+	return []byte(projectionsReverse[*t]), nil
+}
+
+func (t *Projection) UnmarshalJSON(b []byte) error {
+	v, ok := projections[string(b)]
+	if !ok {
+		return ErrProjection
+	}
+	*t = v
+	return nil
+}
+
+// Where the images of the eyes of a stereo camera go.
+type StereoLayout int
+
+const (
+	// A single image from the camera position
+	MONO StereoLayout = iota
+	// The left eye on the left half of the image, the right eye on the
+	// right half
+	SIDE_BY_SIDE
+	// The left eye on the top half of the image, the right eye on the
+	// bottom half
+	OVER_UNDER
+)
+
+var stereoLayouts = map[string]StereoLayout{
+	"\"MONO\"":         MONO,
+	"\"SIDE_BY_SIDE\"": SIDE_BY_SIDE,
+	"\"OVER_UNDER\"":   OVER_UNDER,
+}
+var stereoLayoutsReverse = map[StereoLayout]string{
+	MONO:         "\"MONO\"",
+	SIDE_BY_SIDE: "\"SIDE_BY_SIDE\"",
+	OVER_UNDER:   "\"OVER_UNDER\"",
+}
+
+func (t *StereoLayout) MarshalJSON() ([]byte, error) {
+	return []byte(stereoLayoutsReverse[*t]), nil
+}
+
+func (t *StereoLayout) UnmarshalJSON(b []byte) error {
+	v, ok := stereoLayouts[string(b)]
+	if !ok {
+		return ErrStereo
+	}
+	*t = v
+	return nil
+}
+
+// Cameras can also be given as just their position.
+func (c *Camera) UnmarshalJSON(b []byte) error {
+	if b = bytes.TrimSpace(b); len(b) != 0 && b[0] == '[' {
+		*c = Camera{}
+		return json.Unmarshal(b, &c.Position)
+	}
+	type camera Camera
+	return json.Unmarshal(b, (*camera)(c))
+}
+
+// The directions to the right, up and forward of the camera of the scene,
+// as unit vectors.
+func (s *Scene) CameraBasis() (right, up, forward Vec3) {
+	if s.Camera.LookAt == nil {
+		right = PitchYawRollVector(s.Pitch, s.Yaw, s.Roll, Vec3{1, 0, 0})
+		up = PitchYawRollVector(s.Pitch, s.Yaw, s.Roll, Vec3{0, 1, 0})
+		forward = PitchYawRollVector(s.Pitch, s.Yaw, s.Roll, Vec3{0, 0, 1})
+		return right, up, forward
+	}
+	forward = s.Camera.LookAt.Sub(s.Camera.Position).Normalize()
+	up = s.Camera.Up
+	if up.IsZero() {
+		up = Vec3{0, 1, 0}
+	}
+	right = up.Cross(forward).Normalize()
+	return right, forward.Cross(right), forward
+}
+
+// The distance in front of the camera that is in focus.
+func (c *Camera) Focus() float64 {
+	if c.FocusDistance == 0 && c.LookAt != nil {
+		return c.LookAt.Distance(c.Position)
+	}
+	return c.FocusDistance
+}
+
+// How long the shutter is open, in seconds.
+func (c *Camera) Shutter() float64 {
+	return c.ShutterClose - c.ShutterOpen
+}
+
+// The distance between the eyes of a stereo camera.
+func (c *Camera) EyeDistance() float64 {
+	if c.IPD == 0 {
+		return 0.065
+	}
+	return c.IPD
+}
+
+// A point on the lens chosen by u, v and w in [0, 1), as offsets along the
+// right and up directions of the camera. w picks the blade of a polygonal
+// aperture.
+func (c *Camera) SampleAperture(u, v, w float64) (float64, float64) {
+	if c.Blades == 0 {
+		r, phi := c.Aperture*math.Sqrt(u), 2*math.Pi*v
+		return r * math.Cos(phi), r * math.Sin(phi)
+	}
+
+	// Uniformly in the triangle between the center and one edge
+	blade := math.Floor(w * float64(c.Blades))
+	angle := 2 * math.Pi / float64(c.Blades)
+	a, b := blade*angle, (blade+1)*angle
+	su := math.Sqrt(u)
+	x := su * ((1-v)*math.Cos(a) + v*math.Cos(b))
+	y := su * ((1-v)*math.Sin(a) + v*math.Sin(b))
+	return c.Aperture * x, c.Aperture * y
+}
+
+// The distance from the camera to the image plane of the scene, which is
+// 2*height high.
+func (c *Camera) near(height, fov float64) float64 {
+	switch {
+	case c.FOV > 0:
+		return height / math.Tan(c.FOV*math.Pi/360)
+	case c.FocalLength > 0:
+		return height * c.FocalLength / 12
+	}
+	return math.Abs(fov / math.Tan(fov/2.0))
+}
+
+func (c *Camera) validate() SceneErrors {
+	var errs SceneErrors
+	fail := func(field string, value interface{}, err error) {
+		errs = append(errs, &ObjectError{"camera", 0, field, fmt.Sprint(value), err})
+	}
+	if c.FOV < 0 || c.FOV >= 180 {
+		fail("FOV", c.FOV, ErrFOV)
+	}
+	if c.FocalLength < 0 {
+		fail("FocalLength", c.FocalLength, ErrFocalLength)
+	}
+	if c.Aperture < 0 {
+		fail("Aperture", c.Aperture, ErrAperture)
+	}
+	if c.Blades < 0 || c.Blades == 1 || c.Blades == 2 {
+		fail("Blades", c.Blades, ErrBlades)
+	}
+	if c.FocusDistance < 0 || (c.Aperture > 0 && c.Focus() == 0) {
+		fail("FocusDistance", c.FocusDistance, ErrFocusDistance)
+	}
+	if c.Projection == ORTHOGRAPHIC && c.ViewWidth <= 0 {
+		fail("ViewWidth", c.ViewWidth, ErrViewWidth)
+	}
+	if c.Angle < 0 || c.Angle > 360 {
+		fail("Angle", c.Angle, ErrFisheyeAngle)
+	}
+	if c.IPD < 0 {
+		fail("IPD", c.IPD, ErrIPD)
+	}
+	if c.Convergence < 0 {
+		fail("Convergence", c.Convergence, ErrConvergence)
+	}
+	if c.ShutterClose < c.ShutterOpen {
+		fail("ShutterClose", c.ShutterClose, ErrShutter)
+	}
+	if c.LookAt != nil {
+		forward := c.LookAt.Sub(c.Position)
+		up := c.Up
+		if up.IsZero() {
+			up = Vec3{0, 1, 0}
+		}
+		if forward.IsZero() {
+			fail("LookAt", *c.LookAt, ErrLookAt)
+		} else if up.Cross(forward).IsZero() {
+			fail("Up", up, ErrUp)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,156 @@
+package geometry
+
+import (
+	"math"
+)
+
+// Whether points on the surface of the shape can be sampled, which is not
+// possible for infinite planes.
+func (s *Shape) Sampleable() bool {
+	return s.Type != kindPlane
+}
+
+// Whether the surface of the shape has no inside, so that both of its
+// sides can be seen and emit light.
+func (s *Shape) TwoSided() bool {
+	return s.Type == kindPlane || s.Type == kindTriangle || s.Type == kindMesh
+}
+
+// Picks a point on the surface of the shape as seen from point, using u
+// and v in [0, 1). Returns the point and the probability density of
+// picking the direction towards it, per unit solid angle. Spheres are
+// sampled over the cone they cover, other shapes uniformly by area. pdf is
+// 0 if nothing could be sampled.
+func (s *Shape) SampleSurface(point Vec3, u, v float64) (position Vec3, pdf float64) {
+	switch s.Type {
+	case kindSphere:
+		toCenter := s.Position.Sub(point)
+		distance2 := toCenter.Dot(toCenter)
+		if distance2 <= s.Radius*s.Radius {
+			// Inside the sphere: uniform over its surface
+			position, _, _, _ = s.SampleArea(u, v)
+			return position, s.SurfacePdf(point, position, 0)
+		}
+
+		cosMax := math.Sqrt(1 - s.Radius*s.Radius/distance2)
+		axis := toCenter.Mult(1 / math.Sqrt(distance2))
+		direction := AroundNormal(axis, 1-u*(1-cosMax), 2*math.Pi*v)
+
+		// Closest intersection with the sphere, touching it at the edge
+		// of the cone
+		along := toCenter.Dot(direction)
+		discriminant := math.Max(along*along-distance2+s.Radius*s.Radius, 0)
+		position = point.Add(direction.Mult(along - math.Sqrt(discriminant)))
+		return position, 1 / (2 * math.Pi * (1 - cosMax))
+	case kindCube, kindTriangle, kindMesh:
+		var primitive int
+		position, _, primitive, pdf = s.SampleArea(u, v)
+		if pdf == 0 {
+			return Vec3{}, 0
+		}
+		return position, s.SurfacePdf(point, position, primitive)
+	}
+	return Vec3{}, 0
+}
+
+// Picks a point on the surface of the shape using u and v in [0, 1).
+// Returns it with its outward normal, the primitive it is on and the
+// probability density of picking it per unit area, which is 0 if nothing
+// could be picked. Faces of meshes are chosen uniformly, whatever their
+// size.
+func (s *Shape) SampleArea(u, v float64) (position, normal Vec3, primitive int, pdf float64) {
+	switch s.Type {
+	case kindSphere:
+		z := 1 - 2*u
+		r, phi := math.Sqrt(1-z*z), 2*math.Pi*v
+		normal = Vec3{r * math.Cos(phi), r * math.Sin(phi), z}
+		return s.Position.Add(normal.Mult(s.Radius)), normal, 0, 1 / (4 * math.Pi * s.Radius * s.Radius)
+	case kindCube:
+		// One of the six faces, each 2*Radius wide
+		face := int(u * 6)
+		if face > 5 {
+			face = 5
+		}
+		u = u*6 - float64(face)
+		a, b := (2*u-1)*s.Radius, (2*v-1)*s.Radius
+		var offset Vec3
+		switch face {
+		case 0, 1:
+			offset, normal = Vec3{s.Radius, a, b}, Vec3{1, 0, 0}
+		case 2, 3:
+			offset, normal = Vec3{a, s.Radius, b}, Vec3{0, 1, 0}
+		case 4, 5:
+			offset, normal = Vec3{a, b, s.Radius}, Vec3{0, 0, 1}
+		}
+		if face%2 == 0 {
+			offset, normal = offset.Mult(-1), normal.Mult(-1)
+		}
+		return s.Position.Add(offset), normal, 0, 1 / (24 * s.Radius * s.Radius)
+	case kindTriangle, kindMesh:
+		// A face chosen uniformly, then a point uniformly on it
+		faces := 1
+		if s.Type == kindMesh {
+			faces = len(s.Faces)
+			if faces == 0 {
+				return Vec3{}, Vec3{}, 0, 0
+			}
+			primitive = int(u * float64(faces))
+			if primitive >= faces {
+				primitive = faces - 1
+			}
+			u = u*float64(faces) - float64(primitive)
+		}
+		a, b, c := s.face(primitive)
+		su := math.Sqrt(u)
+		offset := a.Mult(1 - su).Add(b.Mult(su * (1 - v))).Add(c.Mult(su * v))
+		normal = b.Sub(a).Cross(c.Sub(a))
+		area := normal.Abs() / 2
+		if area == 0 {
+			return Vec3{}, Vec3{}, 0, 0
+		}
+		return s.Position.Add(offset), normal.Normalize(), primitive, 1 / (area * float64(faces))
+	}
+	return Vec3{}, Vec3{}, 0, 0
+}
+
+// The probability density per unit solid angle of SampleSurface picking
+// position on the given primitive of the shape as seen from point.
+func (s *Shape) SurfacePdf(point, position Vec3, primitive int) float64 {
+	var area float64
+	var normal Vec3
+	switch s.Type {
+	case kindSphere:
+		toCenter := s.Position.Sub(point)
+		distance2 := toCenter.Dot(toCenter)
+		if distance2 > s.Radius*s.Radius {
+			cosMax := math.Sqrt(1 - s.Radius*s.Radius/distance2)
+			return 1 / (2 * math.Pi * (1 - cosMax))
+		}
+		area = 4 * math.Pi * s.Radius * s.Radius
+		normal = position.Sub(s.Position)
+	case kindCube:
+		area = 24 * s.Radius * s.Radius
+		normal = cubeNormal(s, position)
+	case kindTriangle, kindMesh:
+		a, b, c := s.face(primitive)
+		normal = b.Sub(a).Cross(c.Sub(a))
+		area = normal.Abs() / 2
+		if s.Type == kindMesh {
+			area *= float64(len(s.Faces))
+		}
+	default:
+		return 0
+	}
+
+	// Convert the density per unit area to solid angle
+	toPoint := point.Sub(position)
+	distance2 := toPoint.Dot(toPoint)
+	if distance2 == 0 || area == 0 {
+		return 0
+	}
+	cos := math.Abs(normal.Normalize().Dot(toPoint)) / math.Sqrt(distance2)
+	if cos == 0 {
+		return 0
+	}
+	return distance2 / (cos * area)
+}
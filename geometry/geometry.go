@@ -7,6 +7,9 @@ import (
 
 var ErrShapeType = errors.New("invalid shape type")
 var ErrMaterial = errors.New("invalid material")
+var ErrFresnelModel = errors.New("invalid fresnel model")
+var ErrDistribution = errors.New("invalid microfacet distribution")
+var ErrMetal = errors.New("invalid metal")
 
 type Shape struct {
 	Type     ShapeType
@@ -16,6 +19,55 @@ type Shape struct {
 	Position Vec3
 	Normal   Vec3
 	Radius   float64
+
+	// Moving shapes move by Velocity every second, starting at Position
+	// when the animation starts, and blur while the shutter is open.
+	Velocity Vec3
+
+	// Refractive shapes bend light by their index of refraction, 1.5 like
+	// glass if zero. Fresnel selects how the share of light they reflect
+	// is computed.
+	IOR     float64
+	Fresnel FresnelModel
+
+	// Conductors and dielectrics have microfacets from Distribution, with
+	// Roughness from 0 (smooth) to 1. Conductors reflect light by their
+	// complex index of refraction Eta + iK per color channel, or by that
+	// of Metal if Eta is zero, ignoring Color.
+	Roughness    float64
+	Distribution Distribution
+	Metal        Metal
+	Eta, K       Vec3
+
+	// Principled shapes layer a clearcoat over a mix of a metal and a
+	// dielectric base, in the style of the Disney principled BSDF. Color
+	// is the base color, Roughness and IOR are shared with the materials
+	// above and every other parameter is from 0 to 1. Specular is the
+	// reflectance of the dielectric base, 0.5 for 4%, and defaults to 0.5
+	// like Roughness does. ClearcoatRoughness defaults to 0.03.
+	Metallic           float64
+	Specular           float64
+	Transmission       float64
+	Clearcoat          float64
+	ClearcoatRoughness float64
+
+	// Scales Emission when the scene is read.
+	EmissionStrength float64
+
+	// Triangles and meshes store their vertices relative to Position.
+	// Normals is optional and holds one normal per vertex for smooth
+	// shading. Faces indexes into Vertices and is only used by meshes.
+	Vertices []Vec3
+	Normals  []Vec3
+	Faces    [][3]int
+
+	// OBJ entries reference a Wavefront OBJ file which is loaded by
+	// ParseScene. The model is scaled, then rotated by pitch, yaw and
+	// roll (X, Y, Z of Rotation) and placed at Position. Scale is 1 along
+	// every axis if not given.
+	File     string
+	Scale    Vec3
+	Rotation Vec3
 }
 
 type ShapeType int
@@ -24,17 +76,26 @@ const (
 	kindSphere ShapeType = iota
 	kindPlane
 	kindCube
+	kindTriangle
+	kindMesh
+	kindOBJ
 )
 
 var shapeTypes = map[string]ShapeType{
-	"\"SPHERE\"": kindSphere,
-	"\"PLANE\"":  kindPlane,
-	"\"CUBE\"":   kindCube,
+	"\"SPHERE\"":   kindSphere,
+	"\"PLANE\"":    kindPlane,
+	"\"CUBE\"":     kindCube,
+	"\"TRIANGLE\"": kindTriangle,
+	"\"MESH\"":     kindMesh,
+	"\"OBJ\"":      kindOBJ,
 }
 var shapeTypesReverse = map[ShapeType]string{
-	kindSphere: "\"SPHERE\"",
-	kindPlane:  "\"PLANE\"",
-	kindCube:   "\"CUBE\"",
+	kindSphere:   "\"SPHERE\"",
+	kindPlane:    "\"PLANE\"",
+	kindCube:     "\"CUBE\"",
+	kindTriangle: "\"TRIANGLE\"",
+	kindMesh:     "\"MESH\"",
+	kindOBJ:      "\"OBJ\"",
 }
 
 func (t *ShapeType) MarshalJSON() ([]byte, error) {
@@ -56,17 +117,29 @@ const (
 	DIFFUSE Material = iota
 	SPECULAR
 	REFRACTIVE
+	// Rough metal
+	CONDUCTOR
+	// Rough glass
+	DIELECTRIC
+	// Layered metal, plastic and glass
+	PRINCIPLED
 )
 
 var materials = map[string]Material{
 	"\"DIFFUSE\"":    DIFFUSE,
 	"\"SPECULAR\"":   SPECULAR,
 	"\"REFRACTIVE\"": REFRACTIVE,
+	"\"CONDUCTOR\"":  CONDUCTOR,
+	"\"DIELECTRIC\"": DIELECTRIC,
+	"\"PRINCIPLED\"": PRINCIPLED,
 }
 var materialsReverse = map[Material]string{
 	DIFFUSE:    "\"DIFFUSE\"",
 	SPECULAR:   "\"SPECULAR\"",
 	REFRACTIVE: "\"REFRACTIVE\"",
+	CONDUCTOR:  "\"CONDUCTOR\"",
+	DIELECTRIC: "\"DIELECTRIC\"",
+	PRINCIPLED: "\"PRINCIPLED\"",
 }
 
 func (t *Material) MarshalJSON() ([]byte, error) {
@@ -82,7 +155,40 @@ func (t *Material) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// How the share of light reflected by a refractive surface is computed.
+type FresnelModel int
+
+const (
+	// The Fresnel equations for unpolarized light
+	FRESNEL FresnelModel = iota
+	// Schlick's approximation of the Fresnel equations
+	SCHLICK
+)
+
+var fresnelModels = map[string]FresnelModel{
+	"\"FRESNEL\"": FRESNEL,
+	"\"SCHLICK\"": SCHLICK,
+}
+var fresnelModelsReverse = map[FresnelModel]string{
+	FRESNEL: "\"FRESNEL\"",
+	SCHLICK: "\"SCHLICK\"",
+}
+
+func (t *FresnelModel) MarshalJSON() ([]byte, error) {
+	return []byte(fresnelModelsReverse[*t]), nil
+}
+
+func (t *FresnelModel) UnmarshalJSON(b []byte) error {
+	v, ok := fresnelModels[string(b)]
+	if !ok {
+		return ErrFresnelModel
+	}
+	*t = v
+	return nil
+}
+
 func (s *Shape) Intersects(ray Ray) float64 {
+	ray = s.moving(ray)
 	switch s.Type {
 	case kindSphere:
 		return sphereIntersects(s, ray)
@@ -90,6 +196,10 @@ func (s *Shape) Intersects(ray Ray) float64 {
 		return planeIntersects(s, ray)
 	case kindCube:
 		return cubeIntersects(s, ray)
+	case kindTriangle:
+		return triangleIntersects(s, ray)
+	case kindMesh:
+		return meshIntersects(s, ray)
 	}
 	panic("unreachable")
 }
@@ -102,6 +212,10 @@ func (s *Shape) NormalDir(point Vec3) Vec3 {
 		return planeNormal(s, point)
 	case kindCube:
 		return cubeNormal(s, point)
+	case kindTriangle:
+		return triangleNormal(s, point)
+	case kindMesh:
+		return meshNormal(s, point)
 	}
 	panic("unreachable")
 }
@@ -194,10 +308,11 @@ func cubeIntersects(s *Shape, r Ray) float64 {
 		}
 		dist := intersectPlane(s.Position.Add(normal), normal, r)
 		if dist > 0 && dist < min {
+			// The hit is on the face along its own axis, up to rounding
 			diff := r.Origin.Add(r.Direction.Mult(dist)).Sub(s.Position)
-			if -s.Radius <= diff.X && diff.X <= s.Radius &&
-				-s.Radius <= diff.Y && diff.Y <= s.Radius &&
-				-s.Radius <= diff.Z && diff.Z <= s.Radius {
+			if (i/2 == 0 || math.Abs(diff.X) <= s.Radius) &&
+				(i/2 == 1 || math.Abs(diff.Y) <= s.Radius) &&
+				(i/2 == 2 || math.Abs(diff.Z) <= s.Radius) {
 				min = dist
 			}
 		}
@@ -245,6 +360,9 @@ func cubeNormal(s *Shape, point Vec3) Vec3 {
 	return bestNormal
 }
 
+// Time is when the ray is traced, in seconds after the shutter opened.
+// Shapes have moved by their Velocity by then.
 type Ray struct {
 	Origin, Direction Vec3
+	Time              float64
 }
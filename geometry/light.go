@@ -0,0 +1,201 @@
+package geometry
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrLightType = errors.New("invalid light type")
+var ErrZeroDirection = errors.New("zero length direction")
+var ErrAngle = errors.New("angle must be between 0 and pi/2")
+var ErrFalloff = errors.New("falloff must be between 0 and the angle")
+var ErrZeroArea = errors.New("edges do not span an area")
+
+// A light source that is not part of the geometry of the scene. Color is
+// the intensity of point and spot lights, the irradiance of directional
+// lights and the radiance of area lights.
+//
+// Spot lights shine along Direction in a cone of Angle radians around it,
+// fading out over the outer Falloff radians of the cone. Directional
+// lights shine along Direction from infinitely far away. Area lights are
+// the rectangle spanned by the edges U and V from its corner at Position,
+// emitting from the side U×V points to.
+type Light struct {
+	Type      LightType
+	Color     Vec3
+	Position  Vec3
+	Direction Vec3
+	Angle     float64
+	Falloff   float64
+	U, V      Vec3
+}
+
+type LightType int
+
+const (
+	kindPoint LightType = iota
+	kindSpot
+	kindDirectional
+	kindArea
+)
+
+var lightTypes = map[string]LightType{
+	"\"POINT\"":       kindPoint,
+	"\"SPOT\"":        kindSpot,
+	"\"DIRECTIONAL\"": kindDirectional,
+	"\"AREA\"":        kindArea,
+}
+var lightTypesReverse = map[LightType]string{
+	kindPoint:       "\"POINT\"",
+	kindSpot:        "\"SPOT\"",
+	kindDirectional: "\"DIRECTIONAL\"",
+	kindArea:        "\"AREA\"",
+}
+
+func (t *LightType) MarshalJSON() ([]byte, error) {
+	return []byte(lightTypesReverse[*t]), nil
+}
+
+func (t *LightType) UnmarshalJSON(b []byte) error {
+	v, ok := lightTypes[string(b)]
+	if !ok {
+		return ErrLightType
+	}
+	*t = v
+	return nil
+}
+
+// The light arriving at point from a point on the light chosen by u and v
+// in [0, 1). Returns the direction towards that point, the distance to it,
+// which is infinite for directional lights, and the irradiance it gives a
+// surface facing it.
+func (l *Light) Sample(point Vec3, u, v float64) (Vec3, float64, Vec3) {
+	switch l.Type {
+	case kindPoint, kindSpot:
+		toLight := l.Position.Sub(point)
+		distance2 := toLight.Dot(toLight)
+		direction := toLight.Mult(1 / math.Sqrt(distance2))
+		intensity := l.Color.Mult(l.Spot(direction.Mult(-1)) / distance2)
+		return direction, math.Sqrt(distance2), intensity
+	case kindDirectional:
+		return l.Direction.Normalize().Mult(-1), positiveInfinity, l.Color
+	case kindArea:
+		normal := l.U.Cross(l.V)
+		area := normal.Abs()
+		normal = normal.Mult(1 / area)
+		toLight := l.Position.Add(l.U.Mult(u)).Add(l.V.Mult(v)).Sub(point)
+		distance2 := toLight.Dot(toLight)
+		direction := toLight.Mult(1 / math.Sqrt(distance2))
+		cos := -normal.Dot(direction)
+		if cos <= 0 {
+			return direction, math.Sqrt(distance2), Vec3{0, 0, 0}
+		}
+		return direction, math.Sqrt(distance2), l.Color.Mult(cos * area / distance2)
+	}
+	panic("unreachable")
+}
+
+// The fraction of a spot light's intensity leaving it in direction, 1 for
+// other lights.
+func (l *Light) Spot(direction Vec3) float64 {
+	if l.Type != kindSpot {
+		return 1
+	}
+	cos := direction.Dot(l.Direction.Normalize())
+	outer, inner := math.Cos(l.Angle), math.Cos(math.Max(l.Angle-l.Falloff, 0))
+	switch {
+	case cos <= outer:
+		return 0
+	case cos >= inner:
+		return 1
+	}
+	s := (cos - outer) / (inner - outer)
+	return s * s * (3 - 2*s)
+}
+
+// A photon leaving the light, chosen by u1 to u4 in [0, 1). Directional
+// lights shine on the sphere around center with the given radius. The
+// color of the photon is the share of the light's flux it carries,
+// relative to the 4π of a unit intensity point light.
+func (l *Light) Emit(u1, u2, u3, u4 float64, center Vec3, radius float64) (Ray, Vec3) {
+	switch l.Type {
+	case kindPoint:
+		z := 1 - 2*u1
+		r, phi := math.Sqrt(1-z*z), 2*math.Pi*u2
+		return Ray{l.Position, Vec3{r * math.Cos(phi), r * math.Sin(phi), z}, 0}, l.Color
+	case kindSpot:
+		// Uniform over the cone
+		outer := math.Cos(l.Angle)
+		direction := AroundNormal(l.Direction.Normalize(), 1-u1*(1-outer), 2*math.Pi*u2)
+		return Ray{l.Position, direction, 0}, l.Color.Mult(l.Spot(direction) * (1 - outer) / 2)
+	case kindDirectional:
+		// From a disk covering the sphere
+		direction := l.Direction.Normalize()
+		u, v := OrthonormalBasis(direction)
+		r, phi := radius*math.Sqrt(u1), 2*math.Pi*u2
+		origin := center.Sub(direction.Mult(radius)).
+			Add(u.Mult(r * math.Cos(phi))).
+			Add(v.Mult(r * math.Sin(phi)))
+		return Ray{origin, direction, 0}, l.Color.Mult(radius * radius / 4)
+	case kindArea:
+		// Cosine weighted off the rectangle
+		normal := l.U.Cross(l.V)
+		area := normal.Abs()
+		normal = normal.Mult(1 / area)
+		direction, _ := CosineHemisphere(normal, u3, u4)
+		origin := l.Position.Add(l.U.Mult(u1)).Add(l.V.Mult(u2))
+		return Ray{origin, direction, 0}, l.Color.Mult(area / 4)
+	}
+	panic("unreachable")
+}
+
+// Checks the light described by the index-th entry of the scene file's
+// Lights list. Fields in present were given in the scene file and are
+// true if they could be decoded, checks of fields that failed to decode
+// are skipped.
+func (l *Light) validate(index int, present map[string]bool) SceneErrors {
+	var errs SceneErrors
+	fail := func(field string, value interface{}, err error) {
+		if decoded, given := present[field]; given && !decoded {
+			return
+		}
+		errs = append(errs, &ObjectError{"light", index, field, fmt.Sprint(value), err})
+	}
+	require := func(fields ...string) {
+		for _, field := range fields {
+			if _, ok := present[field]; !ok {
+				errs = append(errs, &ObjectError{"light", index, field, "", ErrMissingField})
+			}
+		}
+	}
+
+	require("Type")
+	if !present["Type"] {
+		return errs
+	}
+
+	switch l.Type {
+	case kindPoint:
+		require("Position")
+	case kindSpot:
+		require("Position")
+		if l.Angle <= 0 || l.Angle > math.Pi/2 {
+			fail("Angle", l.Angle, ErrAngle)
+		}
+		if l.Falloff < 0 || l.Falloff > l.Angle {
+			fail("Falloff", l.Falloff, ErrFalloff)
+		}
+		fallthrough
+	case kindDirectional:
+		if l.Direction.IsZero() {
+			fail("Direction", l.Direction, ErrZeroDirection)
+		}
+	case kindArea:
+		require("Position")
+		if l.U.Cross(l.V).IsZero() {
+			fail("V", l.V, ErrZeroArea)
+		}
+	}
+	return errs
+}
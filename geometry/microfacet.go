@@ -0,0 +1,85 @@
+package geometry
+
+// The distribution of microfacet normals of a rough surface.
+type Distribution int
+
+const (
+	GGX Distribution = iota
+	BECKMANN
+)
+
+var distributions = map[string]Distribution{
+	"\"GGX\"":      GGX,
+	"\"BECKMANN\"": BECKMANN,
+}
+var distributionsReverse = map[Distribution]string{
+	GGX:      "\"GGX\"",
+	BECKMANN: "\"BECKMANN\"",
+}
+
+func (t *Distribution) MarshalJSON() ([]byte, error) {
+	return []byte(distributionsReverse[*t]), nil
+}
+
+func (t *Distribution) UnmarshalJSON(b []byte) error {
+	v, ok := distributions[string(b)]
+	if !ok {
+		return ErrDistribution
+	}
+	*t = v
+	return nil
+}
+
+// Conductors with a known complex index of refraction.
+type Metal int
+
+const (
+	ALUMINIUM Metal = iota
+	COPPER
+	GOLD
+	SILVER
+)
+
+var metals = map[string]Metal{
+	"\"ALUMINIUM\"": ALUMINIUM,
+	"\"COPPER\"":    COPPER,
+	"\"GOLD\"":      GOLD,
+	"\"SILVER\"":    SILVER,
+}
+var metalsReverse = map[Metal]string{
+	ALUMINIUM: "\"ALUMINIUM\"",
+	COPPER:    "\"COPPER\"",
+	GOLD:      "\"GOLD\"",
+	SILVER:    "\"SILVER\"",
+}
+
+func (t *Metal) MarshalJSON() ([]byte, error) {
+	return []byte(metalsReverse[*t]), nil
+}
+
+func (t *Metal) UnmarshalJSON(b []byte) error {
+	v, ok := metals[string(b)]
+	if !ok {
+		return ErrMetal
+	}
+	*t = v
+	return nil
+}
+
+// Real and imaginary parts of the index of refraction of every metal at
+// the red, green and blue wavelengths.
+var metalIORs = map[Metal][2]Vec3{
+	ALUMINIUM: {{1.657, 0.880, 0.521}, {9.224, 6.270, 4.837}},
+	COPPER:    {{0.200, 0.924, 1.102}, {3.912, 2.452, 2.142}},
+	GOLD:      {{0.143, 0.374, 1.442}, {3.983, 2.385, 1.603}},
+	SILVER:    {{0.155, 0.117, 0.138}, {4.828, 3.122, 2.147}},
+}
+
+// The complex index of refraction of a conductor.
+func (s *Shape) ComplexIOR() (eta, k Vec3) {
+	if !s.Eta.IsZero() {
+		return s.Eta, s.K
+	}
+	ior := metalIORs[s.Metal]
+	return ior[0], ior[1]
+}
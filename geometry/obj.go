@@ -0,0 +1,270 @@
+package geometry
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A material as described by a Wavefront MTL file. Only the properties
+// that have a counterpart in Shape are kept.
+type objMaterial struct {
+	Color, Emission Vec3
+	IOR             float64
+	Illum           int
+	hasIllum        bool
+}
+
+func (m *objMaterial) apply(s *Shape) {
+	s.Color = m.Color
+	s.Emission = m.Emission
+	if m.IOR != 1 {
+		s.IOR = m.IOR
+	}
+
+	switch {
+	case !m.hasIllum:
+		// Without an illumination model a non-trivial index of
+		// refraction is the only hint of a transparent material.
+		if m.IOR > 1 {
+			s.Material = REFRACTIVE
+		} else {
+			s.Material = DIFFUSE
+		}
+	case m.Illum == 3 || m.Illum == 5 || m.Illum == 8:
+		s.Material = SPECULAR
+	case m.Illum == 4 || m.Illum == 6 || m.Illum == 7 || m.Illum == 9:
+		s.Material = REFRACTIVE
+	default:
+		s.Material = DIFFUSE
+	}
+}
+
+func parseFloats(fields []string, out ...*float64) error {
+	if len(fields) < len(out) {
+		return fmt.Errorf("expected %d values, got %d", len(out), len(fields))
+	}
+	for i, f := range out {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return err
+		}
+		*f = v
+	}
+	return nil
+}
+
+func parseVec3(fields []string) (Vec3, error) {
+	var v Vec3
+	err := parseFloats(fields, &v.X, &v.Y, &v.Z)
+	return v, err
+}
+
+func loadMTL(filename string, materials map[string]*objMaterial) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var current *objMaterial
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if fields[0] == "newmtl" {
+			if len(fields) < 2 {
+				return fmt.Errorf("%s:%d: newmtl without a name", filename, line)
+			}
+			current = &objMaterial{Color: Vec3{1, 1, 1}, IOR: 1}
+			materials[fields[1]] = current
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		switch fields[0] {
+		case "Kd":
+			current.Color, err = parseVec3(fields[1:])
+		case "Ke":
+			current.Emission, err = parseVec3(fields[1:])
+		case "Ni":
+			err = parseFloats(fields[1:], &current.IOR)
+		case "illum":
+			var illum float64
+			err = parseFloats(fields[1:], &illum)
+			current.Illum, current.hasIllum = int(illum), true
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Resolves a 1-based (or negative, relative) OBJ index into a slice of
+// length n.
+func objIndex(s string, n int) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		i += n
+	} else {
+		i--
+	}
+	if i < 0 || i >= n {
+		return 0, fmt.Errorf("index %s out of range", s)
+	}
+	return i, nil
+}
+
+// Collects the faces using one material into a single mesh. OBJ files
+// index positions and normals separately, so every distinct
+// position/normal pair becomes one mesh vertex.
+type objGroup struct {
+	shape   *Shape
+	indices map[[2]int]int
+}
+
+func (g *objGroup) vertex(positions, normals []Vec3, v, vn int) int {
+	key := [2]int{v, vn}
+	if i, ok := g.indices[key]; ok {
+		return i
+	}
+	i := len(g.shape.Vertices)
+	g.indices[key] = i
+	g.shape.Vertices = append(g.shape.Vertices, positions[v])
+	if vn >= 0 {
+		g.shape.Normals = append(g.shape.Normals, normals[vn])
+	}
+	return i
+}
+
+// Loads a Wavefront OBJ file and any MTL libraries it references. Every
+// material used by the file becomes one mesh. The material, color and
+// emission of base are used for faces without an MTL material and its
+// position is used for every mesh.
+func LoadOBJ(filename string, base Shape) ([]*Shape, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		positions, normals []Vec3
+		groups             []*objGroup
+		current            *objGroup
+	)
+	materials := make(map[string]*objMaterial)
+	byMaterial := make(map[string]*objGroup)
+
+	group := func(name string) *objGroup {
+		if g, ok := byMaterial[name]; ok {
+			return g
+		}
+		shape := base
+		shape.Type = kindMesh
+		shape.File, shape.Scale, shape.Rotation = "", Vec3{}, Vec3{}
+		shape.Vertices, shape.Normals, shape.Faces = nil, nil, nil
+		if m, ok := materials[name]; ok {
+			m.apply(&shape)
+		}
+		g := &objGroup{&shape, make(map[[2]int]int)}
+		byMaterial[name] = g
+		groups = append(groups, g)
+		return g
+	}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "v":
+			var v Vec3
+			if v, err = parseVec3(fields[1:]); err == nil {
+				positions = append(positions, v)
+			}
+		case "vn":
+			var v Vec3
+			if v, err = parseVec3(fields[1:]); err == nil {
+				normals = append(normals, v)
+			}
+		case "mtllib":
+			for _, lib := range fields[1:] {
+				if err = loadMTL(filepath.Join(filepath.Dir(filename), lib), materials); err != nil {
+					return nil, err
+				}
+			}
+		case "usemtl":
+			if len(fields) > 1 {
+				current = group(fields[1])
+			}
+		case "f":
+			if current == nil {
+				current = group("")
+			}
+			err = parseFace(current, positions, normals, fields[1:])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var shapes []*Shape
+	for _, g := range groups {
+		if len(g.shape.Faces) == 0 {
+			continue
+		}
+		// Vertex normals are all or nothing for a mesh.
+		if len(g.shape.Normals) != len(g.shape.Vertices) {
+			g.shape.Normals = nil
+		}
+		shapes = append(shapes, g.shape)
+	}
+	return shapes, nil
+}
+
+func parseFace(g *objGroup, positions, normals []Vec3, fields []string) error {
+	if len(fields) < 3 {
+		return fmt.Errorf("face with %d vertices", len(fields))
+	}
+
+	indices := make([]int, len(fields))
+	for i, field := range fields {
+		parts := strings.Split(field, "/")
+		v, err := objIndex(parts[0], len(positions))
+		if err != nil {
+			return err
+		}
+		vn := -1
+		if len(parts) == 3 && parts[2] != "" {
+			if vn, err = objIndex(parts[2], len(normals)); err != nil {
+				return err
+			}
+		}
+		indices[i] = g.vertex(positions, normals, v, vn)
+	}
+
+	// Polygons are split into a triangle fan.
+	for i := 2; i < len(indices); i++ {
+		g.shape.Faces = append(g.shape.Faces, [3]int{indices[0], indices[i-1], indices[i]})
+	}
+	return nil
+}
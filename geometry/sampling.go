@@ -0,0 +1,36 @@
+package geometry
+
+import (
+	"math"
+)
+
+// Two unit vectors perpendicular to each other and the unit vector normal,
+// so that u, v and normal form a right handed basis.
+func OrthonormalBasis(normal Vec3) (u, v Vec3) {
+	other := Vec3{1, 0, 0}
+	if math.Abs(normal.X) > 0.9 {
+		other = Vec3{0, 1, 0}
+	}
+	u = other.Cross(normal).Normalize()
+	return u, normal.Cross(u)
+}
+
+// The direction with the given polar angle cosine and azimuth around the
+// unit vector normal.
+func AroundNormal(normal Vec3, cos, phi float64) Vec3 {
+	u, v := OrthonormalBasis(normal)
+	sin := math.Sqrt(math.Max(1-cos*cos, 0))
+	return u.Mult(sin * math.Cos(phi)).Add(v.Mult(sin * math.Sin(phi))).Add(normal.Mult(cos))
+}
+
+// A direction in the hemisphere around normal chosen by u and v in [0, 1),
+// more likely closer to it in proportion to the cosine of the angle
+// between them, and its density per unit solid angle.
+func CosineHemisphere(normal Vec3, u, v float64) (Vec3, float64) {
+	cos := math.Sqrt(1 - u)
+	return AroundNormal(normal, cos, 2*math.Pi*v), cos / math.Pi
+}
+
+func CosineHemispherePdf(normal, direction Vec3) float64 {
+	return math.Max(normal.Dot(direction), 0) / math.Pi
+}
@@ -2,39 +2,128 @@ package geometry
 
 import (
 	"encoding/json"
-	"math"
+	"io"
 	"os"
+	"path/filepath"
 )
 
 type Scene struct {
 	Width, Height    float64 `json:"-"`
 	Rows, Cols       int     `json:"-"`
 	Objects          []*Shape
-	Camera           Vec3
+	Lights           []*Light
+	Camera           Camera
 	Pitch, Yaw, Roll float64
 	Near             float64 `json:"-"`
-	PixW, PixH       float64 `json:"-"`
+	Animation        Animation
+
+	// The indices in Objects of the shapes created from each entry of the
+	// scene file's Objects list.
+	entries [][]int
 }
 
-func ParseScene(filename string, width, height, fov float64, cols, rows int) Scene {
+// Reads the scene file and sets up the projection. See ReadScene.
+func ParseScene(filename string, width, height, fov float64, cols, rows int) (Scene, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		return Scene{}, err
 	}
 	defer f.Close()
 
-	var scene Scene
+	return ReadScene(f, filepath.Dir(filename), width, height, fov, cols, rows)
+}
 
-	err = json.NewDecoder(f).Decode(&scene)
-	if err != nil {
-		panic(err)
+// Decodes a JSON scene description from r. Models referenced by OBJ
+// entries are loaded relative to dir. If any objects are invalid the
+// returned error is a SceneErrors listing every problem found.
+func ReadScene(r io.Reader, dir string, width, height, fov float64, cols, rows int) (Scene, error) {
+	// The outer Objects and Lights fields shadow the ones in Scene so that
+	// each object and light can be decoded and validated on its own.
+	var file struct {
+		Scene
+		Objects []json.RawMessage
+		Lights  []json.RawMessage
 	}
 
-	scene.Near = math.Abs(fov / math.Tan(fov/2.0))
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return Scene{}, err
+	}
+
+	scene := file.Scene
+	var errs SceneErrors
+	scene.entries = make([][]int, len(file.Objects))
+	for i, raw := range file.Objects {
+		shape, objErrs := decodeShape(i, raw)
+		if len(objErrs) != 0 {
+			errs = append(errs, objErrs...)
+			continue
+		}
+		shapes := []*Shape{shape}
+		if shape.Type == kindOBJ {
+			var err error
+			if shapes, err = loadModel(shape, dir); err != nil {
+				errs = append(errs, &ObjectError{"object", i, "File", shape.File, err})
+				continue
+			}
+		}
+		for _, s := range shapes {
+			scene.entries[i] = append(scene.entries[i], len(scene.Objects))
+			scene.Objects = append(scene.Objects, s)
+		}
+	}
+	for i, raw := range file.Lights {
+		light, lightErrs := decodeLight(i, raw)
+		if len(lightErrs) != 0 {
+			errs = append(errs, lightErrs...)
+			continue
+		}
+		scene.Lights = append(scene.Lights, light)
+	}
+	errs = append(errs, scene.Camera.validate()...)
+	errs = append(errs, scene.Animation.validate(len(file.Objects))...)
+	if len(errs) != 0 {
+		return Scene{}, errs
+	}
+
+	scene.Near = scene.Camera.near(height, fov)
 	scene.Width, scene.Height = width, height
 	scene.Cols, scene.Rows = cols, rows
-	scene.PixW = 2 * width / float64(cols)
-	scene.PixH = 2 * height / float64(rows)
 
-	return scene
+	return scene, nil
+}
+
+// Loads the meshes of an OBJ entry. Relative file names are resolved
+// against dir.
+func loadModel(object *Shape, dir string) ([]*Shape, error) {
+	filename := object.File
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(dir, filename)
+	}
+	meshes, err := LoadOBJ(filename, *object)
+	if err != nil {
+		return nil, err
+	}
+
+	scale := object.Scale
+	if scale.IsZero() {
+		scale = Vec3{1, 1, 1}
+	}
+	for _, mesh := range meshes {
+		mesh.transform(scale, object.Rotation)
+	}
+	return meshes, nil
+}
+
+// Scales and then rotates the vertices and vertex normals of a mesh
+// around its position.
+func (s *Shape) transform(scale, rotation Vec3) {
+	for i, v := range s.Vertices {
+		s.Vertices[i] = PitchYawRollVector(rotation.X, rotation.Y, rotation.Z, v.MultVec(scale))
+	}
+	// Normals transform with the inverse transpose, which for a scale is
+	// the reciprocal.
+	inverse := Vec3{1 / scale.X, 1 / scale.Y, 1 / scale.Z}
+	for i, n := range s.Normals {
+		s.Normals[i] = PitchYawRollVector(rotation.X, rotation.Y, rotation.Z, n.MultVec(inverse)).Normalize()
+	}
 }
@@ -0,0 +1,169 @@
+package geometry
+
+import (
+	"math"
+)
+
+func Triangle(position, a, b, c, emission, color Vec3, materialType Material) *Shape {
+	return &Shape{
+		Type:     kindTriangle,
+		Material: materialType,
+		Color:    color,
+		Emission: emission,
+		Position: position,
+		Vertices: []Vec3{a, b, c},
+	}
+}
+
+func Mesh(position Vec3, vertices, normals []Vec3, faces [][3]int, emission, color Vec3, materialType Material) *Shape {
+	return &Shape{
+		Type:     kindMesh,
+		Material: materialType,
+		Color:    color,
+		Emission: emission,
+		Position: position,
+		Vertices: vertices,
+		Normals:  normals,
+		Faces:    faces,
+	}
+}
+
+// Returns the vertices of the i-th face of a mesh (or the only face of a
+// triangle) relative to the shape's position.
+func (s *Shape) face(i int) (a, b, c Vec3) {
+	if s.Type == kindTriangle {
+		return s.Vertices[0], s.Vertices[1], s.Vertices[2]
+	}
+	f := s.Faces[i]
+	return s.Vertices[f[0]], s.Vertices[f[1]], s.Vertices[f[2]]
+}
+
+// Interpolates the per-vertex normals of the i-th face. If the shape has
+// no vertex normals the flat face normal is returned instead.
+func (s *Shape) faceNormal(i int, u, v float64) Vec3 {
+	if len(s.Normals) != len(s.Vertices) {
+		a, b, c := s.face(i)
+		return b.Sub(a).Cross(c.Sub(a))
+	}
+	var na, nb, nc Vec3
+	if s.Type == kindTriangle {
+		na, nb, nc = s.Normals[0], s.Normals[1], s.Normals[2]
+	} else {
+		f := s.Faces[i]
+		na, nb, nc = s.Normals[f[0]], s.Normals[f[1]], s.Normals[f[2]]
+	}
+	return na.Mult(1 - u - v).Add(nb.Mult(u)).Add(nc.Mult(v))
+}
+
+// Möller–Trumbore ray/triangle intersection. Returns the distance along
+// the ray and the barycentric coordinates of the hit.
+func intersectTriangle(a, b, c Vec3, r Ray) (float64, float64, float64) {
+	e1 := b.Sub(a)
+	e2 := c.Sub(a)
+	p := r.Direction.Cross(e2)
+	det := e1.Dot(p)
+	if det == 0 {
+		return positiveInfinity, 0, 0
+	}
+	inv := 1 / det
+
+	t := r.Origin.Sub(a)
+	u := t.Dot(p) * inv
+	if u < 0 || u > 1 {
+		return positiveInfinity, 0, 0
+	}
+
+	q := t.Cross(e1)
+	v := r.Direction.Dot(q) * inv
+	if v < 0 || u+v > 1 {
+		return positiveInfinity, 0, 0
+	}
+
+	if dist := e2.Dot(q) * inv; dist > 0 {
+		return dist, u, v
+	}
+	return positiveInfinity, 0, 0
+}
+
+func barycentric(a, b, c, point Vec3) (float64, float64) {
+	e1 := b.Sub(a)
+	e2 := c.Sub(a)
+	ep := point.Sub(a)
+	d11, d12, d22 := e1.Dot(e1), e1.Dot(e2), e2.Dot(e2)
+	d1, d2 := ep.Dot(e1), ep.Dot(e2)
+	denom := d11*d22 - d12*d12
+	if denom == 0 {
+		return 0, 0
+	}
+	return (d22*d1 - d12*d2) / denom, (d11*d2 - d12*d1) / denom
+}
+
+func triangleIntersects(s *Shape, r Ray) float64 {
+	r.Origin = r.Origin.Sub(s.Position)
+	a, b, c := s.face(0)
+	dist, _, _ := intersectTriangle(a, b, c, r)
+	return dist
+}
+
+func meshIntersects(s *Shape, r Ray) float64 {
+	r.Origin = r.Origin.Sub(s.Position)
+	min := positiveInfinity
+	for i := range s.Faces {
+		a, b, c := s.face(i)
+		if dist, _, _ := intersectTriangle(a, b, c, r); dist < min {
+			min = dist
+		}
+	}
+	return min
+}
+
+func triangleNormal(s *Shape, point Vec3) Vec3 {
+	a, b, c := s.face(0)
+	u, v := barycentric(a, b, c, point.Sub(s.Position))
+	return s.faceNormal(0, u, v)
+}
+
+func meshNormal(s *Shape, point Vec3) Vec3 {
+	// The hit face is not remembered between Intersects and NormalDir, so
+	// find the face the point lies on: inside the triangle and closest to
+	// its plane. Points on no face, from rounding, get the normal of the
+	// face nearest to them instead.
+	const epsilon = 1e-6
+	point = point.Sub(s.Position)
+	best, bestDist := -1, positiveInfinity
+	nearest, nearestDist := -1, positiveInfinity
+	var bestU, bestV, nearestU, nearestV float64
+	for i := range s.Faces {
+		a, b, c := s.face(i)
+		normal := b.Sub(a).Cross(c.Sub(a))
+		length := normal.Abs()
+		if length == 0 {
+			continue
+		}
+		u, v := barycentric(a, b, c, point)
+		if u >= -epsilon && v >= -epsilon && u+v <= 1+epsilon {
+			if dist := math.Abs(point.SubDot(a, normal)) / length; dist < bestDist {
+				best, bestDist, bestU, bestV = i, dist, u, v
+			}
+			continue
+		}
+
+		// The closest point of the face, near enough
+		u, v = math.Max(u, 0), math.Max(v, 0)
+		if sum := u + v; sum > 1 {
+			u, v = u/sum, v/sum
+		}
+		closest := a.Add(b.Sub(a).Mult(u)).Add(c.Sub(a).Mult(v))
+		if dist := closest.Sub(point).Abs(); dist < nearestDist {
+			nearest, nearestDist, nearestU, nearestV = i, dist, u, v
+		}
+	}
+	if best < 0 {
+		best, bestU, bestV = nearest, nearestU, nearestV
+	}
+	if best < 0 {
+		// Every face is degenerate, so the mesh cannot be hit
+		return Vec3{0, 0, 0}
+	}
+	return s.faceNormal(best, bestU, bestV)
+}
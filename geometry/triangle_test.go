@@ -0,0 +1,28 @@
+package geometry
+
+import (
+	"testing"
+)
+
+func TestMeshNormal(t *testing.T) {
+	// Two faces of a unit cube meeting along its edge from (1, 0, 0) to
+	// (1, 1, 0)
+	vertices := []Vec3{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {1, 0, 1}, {1, 1, 1}}
+	faces := [][3]int{{0, 2, 1}, {1, 2, 4}}
+	mesh := Mesh(Vec3{0, 0, 5}, vertices, nil, faces, Vec3{}, Vec3{1, 1, 1}, DIFFUSE)
+
+	for _, test := range []struct {
+		point, normal Vec3
+	}{
+		{Vec3{0.5, 0.2, 5}, Vec3{0, 0, -1}},
+		{Vec3{1, 0.6, 5.3}, Vec3{1, 0, 0}},
+		// Off both faces, nearest to the first one
+		{Vec3{0.5, -0.01, 5}, Vec3{0, 0, -1}},
+		// Beyond the far edge of the second face
+		{Vec3{1, 1.1, 5.5}, Vec3{1, 0, 0}},
+	} {
+		if normal := mesh.NormalDir(test.point).Normalize(); normal.Sub(test.normal).Abs() > 1e-9 {
+			t.Errorf("normal at %v is %v, want %v", test.point, normal, test.normal)
+		}
+	}
+}
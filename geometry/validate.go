@@ -0,0 +1,241 @@
+package geometry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var ErrUnknownField = errors.New("unknown field")
+var ErrMissingField = errors.New("missing field")
+var ErrZeroNormal = errors.New("zero length normal")
+var ErrRadius = errors.New("radius must be positive")
+var ErrIOR = errors.New("index of refraction must be positive")
+var ErrRoughness = errors.New("roughness must be between 0 and 1")
+var ErrUnitRange = errors.New("value must be between 0 and 1")
+var ErrEmissionStrength = errors.New("emission strength must not be negative")
+var ErrVertexCount = errors.New("wrong number of vertices")
+var ErrNormalCount = errors.New("number of normals does not match vertices")
+var ErrFaceIndex = errors.New("face index out of range")
+var ErrZeroScale = errors.New("scale must not be zero along any axis")
+
+// Describes a problem with one entry of the Objects or Lights list of a
+// scene, which Kind names as "object" or "light", or with its "camera".
+// Field and Value are empty if the problem is not specific to one field.
+type ObjectError struct {
+	Kind  string
+	Index int
+	Field string
+	Value string
+	Err   error
+}
+
+func (e *ObjectError) Error() string {
+	// There is only one camera
+	name := fmt.Sprintf("%s %d", e.Kind, e.Index)
+	if e.Kind == "camera" {
+		name = e.Kind
+	}
+	switch {
+	case e.Field == "":
+		return fmt.Sprintf("%s: %v", name, e.Err)
+	case e.Value == "":
+		return fmt.Sprintf("%s: %s: %v", name, e.Field, e.Err)
+	}
+	return fmt.Sprintf("%s: %s %s: %v", name, e.Field, e.Value, e.Err)
+}
+
+func (e *ObjectError) Unwrap() error {
+	return e.Err
+}
+
+// Every problem found while reading a scene.
+type SceneErrors []*ObjectError
+
+func (errs SceneErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Decodes one scene object field by field so that every invalid field
+// can be reported, then checks that the shape makes sense.
+func decodeShape(index int, raw json.RawMessage) (*Shape, SceneErrors) {
+	shape := &Shape{}
+	present, errs := decodeFields("object", index, raw, shape)
+	if present == nil {
+		return nil, errs
+	}
+
+	errs = append(errs, shape.validate(index, present)...)
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	shape.applyDefaults(present)
+	return shape, nil
+}
+
+// Decodes one light of the scene file like decodeShape.
+func decodeLight(index int, raw json.RawMessage) (*Light, SceneErrors) {
+	light := &Light{}
+	present, errs := decodeFields("light", index, raw, light)
+	if present == nil {
+		return nil, errs
+	}
+
+	errs = append(errs, light.validate(index, present)...)
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return light, nil
+}
+
+// Decodes the fields of the JSON object raw into the struct target points
+// to one by one. Returns the fields that were given, which are true if
+// they could be decoded, and an error for every field that is unknown or
+// invalid. present is nil if raw is not an object.
+func decodeFields(kind string, index int, raw json.RawMessage, target interface{}) (present map[string]bool, errs SceneErrors) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, SceneErrors{{kind, index, "", "", err}}
+	}
+
+	value := reflect.ValueOf(target).Elem()
+	present = make(map[string]bool)
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		data := fields[key]
+		// Field names are matched case insensitively like encoding/json.
+		field, ok := value.Type().FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, key)
+		})
+		if !ok {
+			errs = append(errs, &ObjectError{kind, index, key, "", ErrUnknownField})
+			continue
+		}
+		target := value.FieldByIndex(field.Index).Addr().Interface()
+		err := json.Unmarshal(data, target)
+		if err != nil {
+			errs = append(errs, &ObjectError{kind, index, field.Name, string(data), err})
+		}
+		present[field.Name] = err == nil
+	}
+	return present, errs
+}
+
+// Fills in the fields of a principled shape that were not given in the
+// scene file and folds EmissionStrength into Emission.
+func (s *Shape) applyDefaults(present map[string]bool) {
+	if s.Material == PRINCIPLED {
+		if !present["Roughness"] {
+			s.Roughness = 0.5
+		}
+		if !present["Specular"] {
+			s.Specular = 0.5
+		}
+		if !present["ClearcoatRoughness"] {
+			s.ClearcoatRoughness = 0.03
+		}
+	}
+	if present["EmissionStrength"] {
+		s.Emission = s.Emission.Mult(s.EmissionStrength)
+		s.EmissionStrength = 0
+	}
+}
+
+// Fields in present were given in the scene file and are true if they
+// could be decoded. Checks depending on a field that failed to decode are
+// skipped as the problem has already been reported.
+func (s *Shape) validate(index int, present map[string]bool) SceneErrors {
+	var errs SceneErrors
+	require := func(fields ...string) {
+		for _, field := range fields {
+			if _, ok := present[field]; !ok {
+				errs = append(errs, &ObjectError{"object", index, field, "", ErrMissingField})
+			}
+		}
+	}
+
+	require("Type")
+	if !present["Type"] {
+		return errs
+	}
+
+	switch s.Type {
+	case kindSphere, kindCube:
+		require("Material", "Position", "Radius")
+		if present["Radius"] && s.Radius <= 0 {
+			errs = append(errs, &ObjectError{"object", index, "Radius", fmt.Sprint(s.Radius), ErrRadius})
+		}
+	case kindPlane:
+		require("Material", "Position", "Normal")
+		if present["Normal"] && s.Normal.IsZero() {
+			errs = append(errs, &ObjectError{"object", index, "Normal", fmt.Sprint(s.Normal), ErrZeroNormal})
+		}
+	case kindTriangle:
+		require("Material", "Vertices")
+		if present["Vertices"] && len(s.Vertices) != 3 {
+			errs = append(errs, &ObjectError{"object", index, "Vertices", fmt.Sprint(len(s.Vertices)), ErrVertexCount})
+		}
+		if len(s.Normals) != 0 && len(s.Normals) != len(s.Vertices) {
+			errs = append(errs, &ObjectError{"object", index, "Normals", fmt.Sprint(len(s.Normals)), ErrNormalCount})
+		}
+	case kindMesh:
+		require("Material", "Vertices", "Faces")
+		if len(s.Normals) != 0 && len(s.Normals) != len(s.Vertices) {
+			errs = append(errs, &ObjectError{"object", index, "Normals", fmt.Sprint(len(s.Normals)), ErrNormalCount})
+		}
+		for _, face := range s.Faces {
+			if face[0] < 0 || face[0] >= len(s.Vertices) ||
+				face[1] < 0 || face[1] >= len(s.Vertices) ||
+				face[2] < 0 || face[2] >= len(s.Vertices) {
+				errs = append(errs, &ObjectError{"object", index, "Faces", fmt.Sprint(face), ErrFaceIndex})
+			}
+		}
+	case kindOBJ:
+		require("File")
+		if present["Scale"] && (s.Scale.X == 0 || s.Scale.Y == 0 || s.Scale.Z == 0) {
+			errs = append(errs, &ObjectError{"object", index, "Scale", fmt.Sprint(s.Scale), ErrZeroScale})
+		}
+	}
+
+	if present["IOR"] && s.IOR <= 0 {
+		errs = append(errs, &ObjectError{"object", index, "IOR", fmt.Sprint(s.IOR), ErrIOR})
+	}
+	if present["Roughness"] && (s.Roughness < 0 || s.Roughness > 1) {
+		errs = append(errs, &ObjectError{"object", index, "Roughness", fmt.Sprint(s.Roughness), ErrRoughness})
+	}
+	unit := func(field string, value float64) {
+		if present[field] && (value < 0 || value > 1) {
+			errs = append(errs, &ObjectError{"object", index, field, fmt.Sprint(value), ErrUnitRange})
+		}
+	}
+	unit("Metallic", s.Metallic)
+	unit("Specular", s.Specular)
+	unit("Transmission", s.Transmission)
+	unit("Clearcoat", s.Clearcoat)
+	unit("ClearcoatRoughness", s.ClearcoatRoughness)
+	if present["EmissionStrength"] && s.EmissionStrength < 0 {
+		errs = append(errs, &ObjectError{"object", index, "EmissionStrength", fmt.Sprint(s.EmissionStrength), ErrEmissionStrength})
+	}
+
+	for _, n := range s.Normals {
+		if n.IsZero() {
+			errs = append(errs, &ObjectError{"object", index, "Normals", fmt.Sprint(n), ErrZeroNormal})
+			break
+		}
+	}
+
+	return errs
+}
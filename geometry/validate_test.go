@@ -0,0 +1,36 @@
+package geometry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestLightRequiredFields(t *testing.T) {
+	for _, test := range []struct {
+		light   string
+		missing []string
+	}{
+		{`null`, []string{"Type"}},
+		{`{}`, []string{"Type"}},
+		{`{"Type": "POINT"}`, []string{"Position"}},
+		{`{"Type": "SPOT", "Direction": [0, -1, 0], "Angle": 0.5}`, []string{"Position"}},
+		{`{"Type": "AREA", "U": [1, 0, 0], "V": [0, 0, 1]}`, []string{"Position"}},
+		{`{"Type": "POINT", "Position": [0, 1, 0]}`, nil},
+		{`{"Type": "DIRECTIONAL", "Direction": [0, -1, 0]}`, nil},
+	} {
+		_, errs := decodeLight(0, json.RawMessage(test.light))
+		var missing []string
+		for _, err := range errs {
+			if !errors.Is(err, ErrMissingField) {
+				t.Errorf("%s: unexpected error %v", test.light, err)
+				continue
+			}
+			missing = append(missing, err.Field)
+		}
+		if fmt.Sprint(missing) != fmt.Sprint(test.missing) {
+			t.Errorf("%s: missing %v, want %v", test.light, missing, test.missing)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package hdr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"github.com/BenLubar/goray/render"
+	"io"
+	"math"
+	"sort"
+)
+
+type PixelType int
+
+const (
+	Half  PixelType = 1
+	Float PixelType = 2
+)
+
+type Compression int
+
+const (
+	NoCompression  Compression = 0
+	ZIPCompression Compression = 3
+)
+
+// Number of scanlines stored together in one chunk of the file
+var linesPerChunk = map[Compression]int{
+	NoCompression:  1,
+	ZIPCompression: 16,
+}
+
+// One named channel of an EXR image
+type channel struct {
+	name  string
+	value func(x, y int) float32
+}
+
+// Writes the framebuffer as a single part scanline OpenEXR image with R, G
+// and B channels. Every AOV pass of the framebuffer is stored as a layer
+// named after it, with a single channel for scalar passes.
+func WriteEXR(w io.Writer, fb *render.Framebuffer, pixelType PixelType, compression Compression) error {
+	channels := rgbChannels("", fb)
+	for a, pass := range fb.Passes {
+		if a.Scalar() {
+			pass := pass
+			channels = append(channels, channel{a.String(), func(x, y int) float32 { return float32(pass.At(x, y).X) }})
+		} else {
+			channels = append(channels, rgbChannels(a.String(), pass)...)
+		}
+	}
+	return writeEXR(w, fb.Width, fb.Height, channels, pixelType, compression)
+}
+
+// The R, G and B channels of a framebuffer. Channel names are prefixed by
+// layer and a dot unless layer is empty.
+func rgbChannels(layer string, fb *render.Framebuffer) []channel {
+	if layer != "" {
+		layer += "."
+	}
+	return []channel{
+		{layer + "R", func(x, y int) float32 { return float32(fb.At(x, y).X) }},
+		{layer + "G", func(x, y int) float32 { return float32(fb.At(x, y).Y) }},
+		{layer + "B", func(x, y int) float32 { return float32(fb.At(x, y).Z) }},
+	}
+}
+
+type exrHeader struct {
+	bytes.Buffer
+}
+
+func (h *exrHeader) attribute(name, kind string, value ...interface{}) {
+	var data bytes.Buffer
+	for _, v := range value {
+		if s, ok := v.(string); ok {
+			data.WriteString(s)
+			data.WriteByte(0)
+			continue
+		}
+		binary.Write(&data, binary.LittleEndian, v)
+	}
+	h.WriteString(name)
+	h.WriteByte(0)
+	h.WriteString(kind)
+	h.WriteByte(0)
+	binary.Write(h, binary.LittleEndian, int32(data.Len()))
+	h.Write(data.Bytes())
+}
+
+func writeEXR(w io.Writer, width, height int, channels []channel, pixelType PixelType, compression Compression) error {
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].name < channels[j].name
+	})
+
+	var header exrHeader
+	header.Write([]byte{0x76, 0x2f, 0x31, 0x01})
+	binary.Write(&header, binary.LittleEndian, int32(2))
+
+	var chlist []interface{}
+	for _, c := range channels {
+		// pixel type, pLinear and reserved bytes, x and y sampling
+		chlist = append(chlist, c.name, int32(pixelType), [4]uint8{}, int32(1), int32(1))
+	}
+	chlist = append(chlist, uint8(0))
+
+	window := [4]int32{0, 0, int32(width - 1), int32(height - 1)}
+	header.attribute("channels", "chlist", chlist...)
+	header.attribute("compression", "compression", uint8(compression))
+	header.attribute("dataWindow", "box2i", window)
+	header.attribute("displayWindow", "box2i", window)
+	header.attribute("lineOrder", "lineOrder", uint8(0))
+	header.attribute("pixelAspectRatio", "float", float32(1))
+	header.attribute("screenWindowCenter", "v2f", [2]float32{0, 0})
+	header.attribute("screenWindowWidth", "float", float32(1))
+	header.WriteByte(0)
+
+	lines := linesPerChunk[compression]
+	numChunks := (height + lines - 1) / lines
+	chunks := make([][]byte, numChunks)
+	for i := range chunks {
+		end := (i + 1) * lines
+		if end > height {
+			end = height
+		}
+		data := scanlines(width, i*lines, end, channels, pixelType)
+		if compression == ZIPCompression {
+			data = zipCompress(data)
+		}
+		chunks[i] = data
+	}
+
+	// Offset table followed by the chunks, each prefixed by its first
+	// scanline and size.
+	offset := uint64(header.Len() + 8*numChunks)
+	for i := range chunks {
+		binary.Write(&header, binary.LittleEndian, offset)
+		offset += uint64(8 + len(chunks[i]))
+	}
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	for i, data := range chunks {
+		prefix := [2]int32{int32(i * lines), int32(len(data))}
+		if err := binary.Write(w, binary.LittleEndian, prefix); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scanlines are stored one after the other, each holding every pixel of
+// the first channel followed by every pixel of the next channel.
+func scanlines(width, start, end int, channels []channel, pixelType PixelType) []byte {
+	var buf bytes.Buffer
+	var b [4]byte
+	for y := start; y < end; y++ {
+		for _, c := range channels {
+			for x := 0; x < width; x++ {
+				v := c.value(x, y)
+				if pixelType == Half {
+					binary.LittleEndian.PutUint16(b[:], toHalf(v))
+					buf.Write(b[:2])
+				} else {
+					binary.LittleEndian.PutUint32(b[:], math.Float32bits(v))
+					buf.Write(b[:])
+				}
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// ZIP compression as done by OpenEXR: the bytes are split into two halves
+// of even and odd bytes, delta encoded and deflated. Data that does not
+// shrink is stored uncompressed.
+func zipCompress(data []byte) []byte {
+	tmp := make([]byte, len(data))
+	half := (len(data) + 1) / 2
+	for i, b := range data {
+		if i%2 == 0 {
+			tmp[i/2] = b
+		} else {
+			tmp[half+i/2] = b
+		}
+	}
+	for i := len(tmp) - 1; i > 0; i-- {
+		tmp[i] = byte(int(tmp[i]) - int(tmp[i-1]) + 128)
+	}
+
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	z.Write(tmp)
+	z.Close()
+	if buf.Len() >= len(data) {
+		return data
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,158 @@
+package hdr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Undoes zipCompress like an OpenEXR reader: inflates the data, undoes the
+// delta encoding and interleaves the two halves again. Data of size bytes
+// that is stored uncompressed is returned as is.
+func zipDecompress(t *testing.T, data []byte, size int) []byte {
+	if len(data) == size {
+		return data
+	}
+	z, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := io.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(tmp); i++ {
+		tmp[i] = byte(int(tmp[i-1]) + int(tmp[i]) - 128)
+	}
+	out := make([]byte, len(tmp))
+	half := (len(tmp) + 1) / 2
+	for i := range out {
+		if i%2 == 0 {
+			out[i] = tmp[i/2]
+		} else {
+			out[i] = tmp[half+i/2]
+		}
+	}
+	return out
+}
+
+func TestZIPRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	gradient := func(x, y int) float32 { return float32(x+y) / 10 }
+	noise := func(x, y int) float32 { return r.Float32() }
+	for _, test := range []struct {
+		name       string
+		width      int
+		value      func(x, y int) float32
+		compressed bool
+	}{
+		{"gradient", 64, gradient, true},
+		{"odd length", 33, gradient, true},
+		{"noise", 64, noise, false},
+	} {
+		channels := []channel{{"R", test.value}, {"G", test.value}, {"B", test.value}}
+		data := scanlines(test.width, 0, 1, channels, Half)
+		if test.width%2 == 1 {
+			// An odd number of bytes
+			data = data[:len(data)-1]
+		}
+		compressed := zipCompress(data)
+		if (len(compressed) < len(data)) != test.compressed {
+			t.Errorf("%s: %d bytes compressed to %d", test.name, len(data), len(compressed))
+		}
+		if got := zipDecompress(t, compressed, len(data)); !bytes.Equal(got, data) {
+			t.Errorf("%s: round trip changed the data", test.name)
+		}
+	}
+}
+
+// Reads a null terminated string from the start of b.
+func readString(t *testing.T, b *bytes.Buffer) string {
+	s, err := b.ReadString(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(s, "\x00")
+}
+
+func TestEXRHeader(t *testing.T) {
+	const width, height = 5, 20
+	value := func(x, y int) float32 { return float32(x * y) }
+	channels := []channel{{"depth", value}, {"R", value}, {"albedo.G", value}, {"B", value}, {"G", value}}
+	for _, compression := range []Compression{NoCompression, ZIPCompression} {
+		var out bytes.Buffer
+		if err := writeEXR(&out, width, height, channels, Half, compression); err != nil {
+			t.Fatal(err)
+		}
+		file := out.Bytes()
+		b := bytes.NewBuffer(file)
+
+		var magic, version int32
+		binary.Read(b, binary.LittleEndian, &magic)
+		binary.Read(b, binary.LittleEndian, &version)
+		if magic != 20000630 || version != 2 {
+			t.Fatalf("magic %d, version %d", magic, version)
+		}
+
+		// The channels must be sorted by name
+		var names []string
+		for {
+			name := readString(t, b)
+			if name == "" {
+				break
+			}
+			readString(t, b)
+			var size int32
+			binary.Read(b, binary.LittleEndian, &size)
+			value := bytes.NewBuffer(b.Next(int(size)))
+			if name != "channels" {
+				continue
+			}
+			for {
+				channel := readString(t, value)
+				if channel == "" {
+					break
+				}
+				names = append(names, channel)
+				var info struct {
+					PixelType            int32
+					Linear               [4]uint8
+					XSampling, YSampling int32
+				}
+				binary.Read(value, binary.LittleEndian, &info)
+				if info.PixelType != int32(Half) {
+					t.Errorf("channel %s has pixel type %d", channel, info.PixelType)
+				}
+			}
+		}
+		if got, want := strings.Join(names, " "), "B G R albedo.G depth"; got != want {
+			t.Errorf("channels %s, want %s", got, want)
+		}
+
+		// Every offset points at the next chunk and its first scanline,
+		// and the last chunk ends the file.
+		lines := linesPerChunk[compression]
+		chunks := (height + lines - 1) / lines
+		offsets := make([]uint64, chunks)
+		binary.Read(b, binary.LittleEndian, offsets)
+		next := uint64(len(file) - b.Len())
+		for i, offset := range offsets {
+			if offset != next {
+				t.Fatalf("compression %d: chunk %d at %d, want %d", compression, i, offset, next)
+			}
+			var prefix [2]int32
+			binary.Read(bytes.NewReader(file[offset:]), binary.LittleEndian, &prefix)
+			if int(prefix[0]) != i*lines {
+				t.Errorf("compression %d: chunk %d starts at scanline %d", compression, i, prefix[0])
+			}
+			next = offset + 8 + uint64(prefix[1])
+		}
+		if next != uint64(len(file)) {
+			t.Errorf("compression %d: chunks end at %d of %d bytes", compression, next, len(file))
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package hdr
+
+import (
+	"math"
+)
+
+// Converts a float32 to the bits of an IEEE 754 half precision float,
+// rounding to the nearest even value. Values too large for a half become
+// infinity.
+func toHalf(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	biased := int(bits>>23) & 0xff
+	mantissa := bits & 0x7fffff
+
+	if biased == 0xff {
+		if mantissa != 0 {
+			return sign | 0x7e00 // NaN
+		}
+		return sign | 0x7c00 // Infinity
+	}
+
+	exponent := biased - 127 + 15
+	if exponent >= 0x1f {
+		return sign | 0x7c00
+	}
+
+	if exponent <= 0 {
+		// Subnormal half, or too small to be represented at all.
+		if exponent < -10 {
+			return sign
+		}
+		mantissa |= 0x800000
+		shift := uint(14 - exponent)
+		half := uint16(mantissa >> shift)
+		rest, halfway := mantissa&(1<<shift-1), uint32(1)<<(shift-1)
+		if rest > halfway || (rest == halfway && half&1 == 1) {
+			half++
+		}
+		return sign | half
+	}
+
+	// Rounding up may carry into the exponent, which is still correct.
+	half := sign | uint16(exponent)<<10 | uint16(mantissa>>13)
+	if rest := mantissa & 0x1fff; rest > 0x1000 || (rest == 0x1000 && half&1 == 1) {
+		half++
+	}
+	return half
+}
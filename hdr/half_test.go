@@ -0,0 +1,51 @@
+package hdr
+
+import (
+	"math"
+	"testing"
+)
+
+func TestToHalf(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		f    float32
+		half uint16
+	}{
+		{"zero", 0, 0x0000},
+		{"negative zero", float32(math.Copysign(0, -1)), 0x8000},
+		{"one", 1, 0x3c00},
+		{"minus two", -2, 0xc000},
+		{"largest", 65504, 0x7bff},
+		{"smallest normal", float32(math.Ldexp(1, -14)), 0x0400},
+
+		{"smallest subnormal", float32(math.Ldexp(1, -24)), 0x0001},
+		{"largest subnormal", float32(math.Ldexp(1023, -24)), 0x03ff},
+		{"negative subnormal", float32(math.Ldexp(-3, -24)), 0x8003},
+		{"subnormal halfway down to even", float32(math.Ldexp(5, -25)), 0x0002},
+		{"subnormal halfway up to even", float32(math.Ldexp(3, -25)), 0x0002},
+		{"subnormal rounding up to normal", float32(math.Ldexp(2047, -25)), 0x0400},
+		{"halfway to the smallest subnormal", float32(math.Ldexp(1, -25)), 0x0000},
+		{"above halfway to the smallest subnormal", float32(math.Ldexp(1.5, -25)), 0x0001},
+		{"underflow", float32(math.Ldexp(1, -30)), 0x0000},
+		{"negative underflow", float32(math.Ldexp(-1, -30)), 0x8000},
+
+		{"halfway down to even", 1 + float32(math.Ldexp(1, -11)), 0x3c00},
+		{"halfway up to even", 1 + float32(math.Ldexp(3, -11)), 0x3c02},
+		{"above halfway", 1 + float32(math.Ldexp(1, -11)+math.Ldexp(1, -20)), 0x3c01},
+		{"below halfway", 1 + float32(math.Ldexp(1, -11)-math.Ldexp(1, -20)), 0x3c00},
+		{"rounding into the next exponent", 2 - float32(math.Ldexp(1, -12)), 0x4000},
+
+		{"halfway to overflow", 65520, 0x7c00},
+		{"below halfway to overflow", 65519, 0x7bff},
+		{"overflow", 1e6, 0x7c00},
+		{"negative overflow", -1e6, 0xfc00},
+		{"infinity", float32(math.Inf(1)), 0x7c00},
+		{"negative infinity", float32(math.Inf(-1)), 0xfc00},
+		{"NaN", float32(math.NaN()), 0x7e00},
+		{"negative NaN", math.Float32frombits(0xffc00001), 0xfe00},
+	} {
+		if half := toHalf(test.f); half != test.half {
+			t.Errorf("%s: toHalf(%v) = %#04x, want %#04x", test.name, test.f, half, test.half)
+		}
+	}
+}
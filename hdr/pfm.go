@@ -0,0 +1,42 @@
+package hdr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/BenLubar/goray/render"
+	"io"
+	"math"
+)
+
+// Writes the framebuffer as a color Portable Float Map. PFM stores rows
+// from the bottom up, and a negative scale marks little endian data.
+func WritePFM(w io.Writer, fb *render.Framebuffer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "PF\n%d %d\n-1.0\n", fb.Width, fb.Height)
+	var buf [12]byte
+	for y := fb.Height - 1; y >= 0; y-- {
+		for x := 0; x < fb.Width; x++ {
+			c := fb.At(x, y)
+			binary.LittleEndian.PutUint32(buf[0:], math.Float32bits(float32(c.X)))
+			binary.LittleEndian.PutUint32(buf[4:], math.Float32bits(float32(c.Y)))
+			binary.LittleEndian.PutUint32(buf[8:], math.Float32bits(float32(c.Z)))
+			b.Write(buf[:])
+		}
+	}
+	return b.Flush()
+}
+
+// Writes the X component of every pixel as a grayscale Portable Float Map.
+func WriteGrayPFM(w io.Writer, fb *render.Framebuffer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "Pf\n%d %d\n-1.0\n", fb.Width, fb.Height)
+	var buf [4]byte
+	for y := fb.Height - 1; y >= 0; y-- {
+		for x := 0; x < fb.Width; x++ {
+			binary.LittleEndian.PutUint32(buf[:], math.Float32bits(float32(fb.At(x, y).X)))
+			b.Write(buf[:])
+		}
+	}
+	return b.Flush()
+}
@@ -0,0 +1,38 @@
+package hdr
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/BenLubar/goray/geometry"
+	"github.com/BenLubar/goray/render"
+	"io"
+	"math"
+)
+
+// Writes the framebuffer as an uncompressed Radiance RGBE (.hdr) image.
+func WriteRGBE(w io.Writer, fb *render.Framebuffer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y %d +X %d\n", fb.Height, fb.Width)
+	for _, c := range fb.Pix {
+		pixel := rgbe(c)
+		b.Write(pixel[:])
+	}
+	return b.Flush()
+}
+
+// Stores the color as three mantissas sharing the exponent of the largest
+// component.
+func rgbe(c geometry.Vec3) [4]byte {
+	v := math.Max(c.X, math.Max(c.Y, c.Z))
+	if v < 1e-32 {
+		return [4]byte{}
+	}
+	mantissa, exponent := math.Frexp(v)
+	scale := mantissa * 256 / v
+	return [4]byte{
+		byte(math.Max(0, c.X*scale)),
+		byte(math.Max(0, c.Y*scale)),
+		byte(math.Max(0, c.Z*scale)),
+		byte(exponent + 128),
+	}
+}
@@ -1,8 +1,10 @@
 package kd
 
 import (
+	"container/heap"
 	"github.com/BenLubar/goray/geometry"
-	"sort"
+	"math"
+	"sync"
 )
 
 const (
@@ -11,22 +13,16 @@ const (
 	DIM_Z = 2
 )
 
-// The KDNodes are the nodes in the tree
-// It has a value, a splitting dimension and left and right childs.
-type KDNode struct {
-	Position    geometry.Vec3
-	Split       int
-	Left, Right *KDNode
+// Anything stored in a KD-tree, located by its position.
+type Point interface {
+	Position() geometry.Vec3
 }
 
-// Convinience distance function
-func (me *KDNode) Distance(other geometry.Vec3) float64 {
-	return me.Position.Distance(other)
-}
-
-// Convinience distance^2 function
-func (me *KDNode) Distance2(other geometry.Vec3) float64 {
-	return me.Position.Distance2(other)
+// A KD-tree stored in a flat array. The root is the median of the array,
+// every item before it is in the left subtree and every item after it in
+// the right subtree, split recursively on the next dimension the same way.
+type Tree[T Point] struct {
+	items []T
 }
 
 // Extract the correct value from the geometry.Vec3 to compare on
@@ -42,23 +38,6 @@ func comparingValue(item geometry.Vec3, dimension int) float64 {
 	panic("Trying to get higher dimensional value")
 }
 
-type valueList struct {
-	values    []geometry.Vec3
-	dimension int
-}
-
-func (l valueList) Len() int {
-	return len(l.values)
-}
-
-func (l valueList) Less(i, j int) bool {
-	return comparingValue(l.values[i], l.dimension) < comparingValue(l.values[j], l.dimension)
-}
-
-func (l valueList) Swap(i, j int) {
-	l.values[i], l.values[j] = l.values[j], l.values[i]
-}
-
 // Debugging functions calculating the KD tree depth
 func max(a, b int) int {
 	if a > b {
@@ -67,80 +46,251 @@ func max(a, b int) int {
 	return b
 }
 
-func (k *KDNode) Depth() int {
-	if k == nil {
+func (t *Tree[T]) Depth() int {
+	return depth(0, len(t.items))
+}
+
+func depth(lo, hi int) int {
+	if lo >= hi {
 		return 0
 	}
-	depth := max(k.Left.Depth(), k.Right.Depth())
+	median := (lo + hi) / 2
+	return 1 + max(depth(lo, median), depth(median+1, hi))
+}
 
-	return 1 + depth
+func (t *Tree[T]) Len() int {
+	return len(t.items)
 }
 
-// Creates a new KD-tree by taking a *list.List of KDValues
-// Works by finding the median in every dimension and
-// recursivly creating KD-trees as children untill the list is empty.
+// Creates a new KD-tree of the items, which are reordered in place and
+// kept by the tree. Works by selecting the median in every dimension and
+// recursivly arranging the items before and after it until every subtree
+// is empty.
 //
-// Uses Go routines and channels to acheive concurrency.
-// Every level creates one new Go routine and processes one sub-tree
-// on it's own.
-func New(items []geometry.Vec3) *KDNode {
-	return create(items, 0)
+// Large subtrees are built concurrently, one half on a new Go routine.
+func New[T Point](items []T) *Tree[T] {
+	create(items, 0)
+	return &Tree[T]{items}
 }
 
-func create(l []geometry.Vec3, depth int) *KDNode {
-	if len(l) == 0 {
-		return nil
+// Subtrees with at least this many items build their halves in parallel
+const parallelThreshold = 1 << 14
+
+func create[T Point](l []T, depth int) {
+	if len(l) <= 1 {
+		return
 	}
 
-	// Sort the array
-	sort.Sort(valueList{l, depth % 3})
 	median := len(l) / 2
-	// Adjust the median to make sure it's the FIRST of any
-	// identical values
-	dimension := depth % 3
-	forbiddenValue := comparingValue(l[median], dimension)
-	for comparingValue(l[median], dimension) == forbiddenValue && median > 0 {
-		median--
+	nthElement(l, median, depth%3)
+
+	if len(l) < parallelThreshold {
+		create(l[:median], depth+1)
+		create(l[median+1:], depth+1)
+		return
 	}
-	value := l[median]
 
-	left := create(l[:median], depth+1)
-	right := create(l[median+1:], depth+1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		create(l[:median], depth+1)
+		wg.Done()
+	}()
+	create(l[median+1:], depth+1)
+	wg.Wait()
+}
+
+// Reorders l so that l[n] is the item that would be there if l was sorted
+// on dimension, with no greater items before it and no smaller ones after
+// it. Runs in linear time on average.
+func nthElement[T Point](l []T, n, dimension int) {
+	lo, hi := 0, len(l)
+	for hi-lo > 1 {
+		// Median of three pivot
+		a := comparingValue(l[lo].Position(), dimension)
+		b := comparingValue(l[(lo+hi)/2].Position(), dimension)
+		c := comparingValue(l[hi-1].Position(), dimension)
+		pivot := math.Max(math.Min(a, b), math.Min(math.Max(a, b), c))
+
+		// Three way partition into items smaller than, equal to and
+		// greater than the pivot, so equal items are never revisited
+		lt, i, gt := lo, lo, hi
+		for i < gt {
+			v := comparingValue(l[i].Position(), dimension)
+			switch {
+			case v < pivot:
+				l[lt], l[i] = l[i], l[lt]
+				lt++
+				i++
+			case v > pivot:
+				gt--
+				l[i], l[gt] = l[gt], l[i]
+			default:
+				i++
+			}
+		}
+
+		switch {
+		case n < lt:
+			hi = lt
+		case n >= gt:
+			lo = gt
+		default:
+			return
+		}
+	}
+}
 
-	return &KDNode{value, dimension, left, right}
+// Searches the tree for any items within radius r from the target point.
+// By comparing every point to the leftmost and rightmost point to the
+// resulting sphere irrelevant subtrees are cut of.
+func (t *Tree[T]) Neighbors(point geometry.Vec3, r float64) []T {
+	return t.Searcher().Neighbors(point, r)
 }
 
-// Searches the tree for any nodes within radius r
-// from the target point. This is currently rather slow
-// but accurate. By comparing every point to the leftmost
-// and rightmost point to the resulting sphere
-// irrelevant subtrees are cut of.
-func (tree *KDNode) Neighbors(point geometry.Vec3, r float64) []*KDNode {
-	return tree.neighbors(point, r, nil)
+// Searches a tree like its Neighbors and KNearest methods, but keeps the
+// storage of earlier searches, so that searching stops allocating once it
+// has grown large enough. The items found are only valid until the next
+// search. A Searcher must only be used by one Go routine at a time.
+type Searcher[T Point] struct {
+	tree  *Tree[T]
+	heap  nearestHeap
+	items []T
 }
 
-func (tree *KDNode) neighbors(point geometry.Vec3, r float64, result []*KDNode) []*KDNode {
-	if tree == nil {
+func (t *Tree[T]) Searcher() *Searcher[T] {
+	return &Searcher[T]{tree: t}
+}
+
+func (s *Searcher[T]) Neighbors(point geometry.Vec3, r float64) []T {
+	s.items = s.tree.neighbors(point, r, 0, len(s.tree.items), 0, s.items[:0])
+	return s.items
+}
+
+func (t *Tree[T]) neighbors(point geometry.Vec3, r float64, lo, hi, depth int, result []T) []T {
+	if lo >= hi {
 		return result
 	}
+	median := (lo + hi) / 2
+	position := t.items[median].Position()
 
 	// Am I part of the sphere?
 	// Compare Distance² to r² to avoid calling sqrt
-	if tree.Distance2(point) < r*r {
-		result = append(result, tree)
+	if position.Distance2(point) < r*r {
+		result = append(result, t.items[median])
 	}
 
-	split := tree.Split
+	split := depth % 3
 	// Is the leftmost point to the left of us?
-	if comparingValue(tree.Position, split) > comparingValue(point, split)-r {
-		result = tree.Left.neighbors(point, r, result)
+	if comparingValue(position, split) > comparingValue(point, split)-r {
+		result = t.neighbors(point, r, lo, median, depth+1, result)
 	}
 
 	// Is the rightmost point to the right of us?
-	if comparingValue(tree.Position, split) < comparingValue(point, split)+r {
-		result = tree.Right.neighbors(point, r, result)
+	if comparingValue(position, split) < comparingValue(point, split)+r {
+		result = t.neighbors(point, r, median+1, hi, depth+1, result)
 	}
 
-	// Return all the found nodes
+	// Return all the found items
 	return result
 }
+
+// A max-heap of the indices of the nearest items found so far, farthest
+// first
+type nearestHeap struct {
+	indices   []int
+	distances []float64
+}
+
+func (h *nearestHeap) Len() int {
+	return len(h.indices)
+}
+
+func (h *nearestHeap) Less(i, j int) bool {
+	return h.distances[i] > h.distances[j]
+}
+
+func (h *nearestHeap) Swap(i, j int) {
+	h.indices[i], h.indices[j] = h.indices[j], h.indices[i]
+	h.distances[i], h.distances[j] = h.distances[j], h.distances[i]
+}
+
+func (h *nearestHeap) Push(x interface{}) {
+	panic("nearestHeap is pushed to directly")
+}
+
+func (h *nearestHeap) Pop() interface{} {
+	n := len(h.indices) - 1
+	index := h.indices[n]
+	h.indices, h.distances = h.indices[:n], h.distances[:n]
+	return index
+}
+
+// Searches the tree for the k items closest to point that are within
+// maxRadius of it. The items are returned closest first, together with the
+// distance to the farthest of them, or maxRadius if fewer than k were
+// found.
+func (t *Tree[T]) KNearest(point geometry.Vec3, k int, maxRadius float64) ([]T, float64) {
+	return t.Searcher().KNearest(point, k, maxRadius)
+}
+
+func (s *Searcher[T]) KNearest(point geometry.Vec3, k int, maxRadius float64) ([]T, float64) {
+	if k <= 0 {
+		return nil, maxRadius
+	}
+	h := &s.heap
+	h.indices, h.distances = h.indices[:0], h.distances[:0]
+	s.tree.nearest(point, k, maxRadius*maxRadius, 0, len(s.tree.items), 0, h)
+
+	n := len(h.indices)
+	radius := maxRadius
+	if n == k {
+		radius = math.Sqrt(h.distances[0])
+	}
+	if cap(s.items) < n {
+		s.items = make([]T, n)
+	}
+	s.items = s.items[:n]
+	for i := n - 1; i >= 0; i-- {
+		s.items[i] = s.tree.items[heap.Pop(h).(int)]
+	}
+	return s.items, radius
+}
+
+// r2 is the squared search radius, which shrinks to the distance of the
+// farthest item once k items are found.
+func (t *Tree[T]) nearest(point geometry.Vec3, k int, r2 float64, lo, hi, depth int, h *nearestHeap) float64 {
+	if lo >= hi {
+		return r2
+	}
+	median := (lo + hi) / 2
+	position := t.items[median].Position()
+
+	if d2 := position.Distance2(point); d2 < r2 {
+		if len(h.indices) < k {
+			h.indices = append(h.indices, median)
+			h.distances = append(h.distances, d2)
+			heap.Fix(h, len(h.indices)-1)
+		} else {
+			h.indices[0], h.distances[0] = median, d2
+			heap.Fix(h, 0)
+		}
+		if len(h.indices) == k {
+			r2 = h.distances[0]
+		}
+	}
+
+	// Search the side of the split containing point first, as it is more
+	// likely to shrink the radius.
+	split := depth % 3
+	diff := comparingValue(point, split) - comparingValue(position, split)
+	nearLo, nearHi, farLo, farHi := lo, median, median+1, hi
+	if diff > 0 {
+		nearLo, nearHi, farLo, farHi = median+1, hi, lo, median
+	}
+	r2 = t.nearest(point, k, r2, nearLo, nearHi, depth+1, h)
+	if diff*diff < r2 {
+		r2 = t.nearest(point, k, r2, farLo, farHi, depth+1, h)
+	}
+	return r2
+}
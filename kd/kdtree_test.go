@@ -0,0 +1,163 @@
+package kd
+
+import (
+	"github.com/BenLubar/goray/geometry"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+type benchPoint geometry.Vec3
+
+func (p benchPoint) Position() geometry.Vec3 {
+	return geometry.Vec3(p)
+}
+
+func benchPoints(n int) []benchPoint {
+	r := rand.New(rand.NewSource(1))
+	points := make([]benchPoint, n)
+	for i := range points {
+		points[i] = benchPoint{r.Float64(), r.Float64(), r.Float64()}
+	}
+	return points
+}
+
+// The construction used before median selection, sorting every subtree
+func createSorted(l []benchPoint, depth int) {
+	if len(l) <= 1 {
+		return
+	}
+
+	dimension := depth % 3
+	sort.Slice(l, func(i, j int) bool {
+		return comparingValue(l[i].Position(), dimension) < comparingValue(l[j].Position(), dimension)
+	})
+	median := len(l) / 2
+
+	createSorted(l[:median], depth+1)
+	createSorted(l[median+1:], depth+1)
+}
+
+func benchmarkNew(b *testing.B, n int, build func([]benchPoint)) {
+	points := benchPoints(n)
+	items := make([]benchPoint, n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		copy(items, points)
+		b.StartTimer()
+		build(items)
+	}
+}
+
+func newTree(items []benchPoint) {
+	New(items)
+}
+
+func newSorted(items []benchPoint) {
+	createSorted(items, 0)
+}
+
+func BenchmarkNew1K(b *testing.B)         { benchmarkNew(b, 1000, newTree) }
+func BenchmarkNew100K(b *testing.B)       { benchmarkNew(b, 100000, newTree) }
+func BenchmarkNew1M(b *testing.B)         { benchmarkNew(b, 1000000, newTree) }
+func BenchmarkNewSorted1K(b *testing.B)   { benchmarkNew(b, 1000, newSorted) }
+func BenchmarkNewSorted100K(b *testing.B) { benchmarkNew(b, 100000, newSorted) }
+func BenchmarkNewSorted1M(b *testing.B)   { benchmarkNew(b, 1000000, newSorted) }
+
+// Random points on a coarse grid, so that many share coordinates
+func testPoints(n int, seed int64) []benchPoint {
+	r := rand.New(rand.NewSource(seed))
+	points := make([]benchPoint, n)
+	for i := range points {
+		points[i] = benchPoint{float64(r.Intn(16)), float64(r.Intn(16)), r.Float64() * 16}
+	}
+	return points
+}
+
+// Checks that every subtree has no greater items before its median and no
+// smaller ones after it in the dimension it splits.
+func checkSplits(t *testing.T, items []benchPoint, lo, hi, depth int) {
+	if lo >= hi {
+		return
+	}
+	median := (lo + hi) / 2
+	split := comparingValue(items[median].Position(), depth%3)
+	for i := lo; i < hi; i++ {
+		v := comparingValue(items[i].Position(), depth%3)
+		if (i < median && v > split) || (i > median && v < split) {
+			t.Fatalf("item %d at %v is on the wrong side of the median %d at %v", i, items[i], median, items[median])
+		}
+	}
+	checkSplits(t, items, lo, median, depth+1)
+	checkSplits(t, items, median+1, hi, depth+1)
+}
+
+func sortByDistance(points []benchPoint, target geometry.Vec3) {
+	sort.SliceStable(points, func(i, j int) bool {
+		return geometry.Vec3(points[i]).Distance2(target) < geometry.Vec3(points[j]).Distance2(target)
+	})
+}
+
+func TestTree(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 100, parallelThreshold - 1, parallelThreshold + 1, 3 * parallelThreshold} {
+		points := testPoints(n, int64(n))
+		tree := New(append([]benchPoint(nil), points...))
+		if tree.Len() != n {
+			t.Fatalf("%d points: tree has %d items", n, tree.Len())
+		}
+		checkSplits(t, tree.items, 0, n, 0)
+
+		r := rand.New(rand.NewSource(int64(n) + 1))
+		search := tree.Searcher()
+		for q := 0; q < 20; q++ {
+			target := geometry.Vec3{float64(r.Intn(16)), float64(r.Intn(16)), r.Float64() * 16}
+			radius := r.Float64() * 4
+
+			var want []benchPoint
+			for _, p := range points {
+				if geometry.Vec3(p).Distance2(target) < radius*radius {
+					want = append(want, p)
+				}
+			}
+			got := search.Neighbors(target, radius)
+			if len(got) != len(want) {
+				t.Fatalf("%d points: Neighbors(%v, %v) found %d items, want %d", n, target, radius, len(got), len(want))
+			}
+			seen := make(map[benchPoint]int)
+			for _, p := range want {
+				seen[p]++
+			}
+			for _, p := range got {
+				if seen[p]--; seen[p] < 0 {
+					t.Fatalf("%d points: Neighbors(%v, %v) found %v too often", n, target, radius, p)
+				}
+			}
+
+			k := 1 + r.Intn(32)
+			sortByDistance(want, target)
+			nearest, found := search.KNearest(target, k, radius)
+			if len(want) > k {
+				want = want[:k]
+			}
+			if len(nearest) != len(want) {
+				t.Fatalf("%d points: KNearest(%v, %d, %v) found %d items, want %d", n, target, k, radius, len(nearest), len(want))
+			}
+			for i, p := range nearest {
+				// Ties may come in any order, so only distances are compared
+				got, want := geometry.Vec3(p).Distance2(target), geometry.Vec3(want[i]).Distance2(target)
+				if got != want {
+					t.Fatalf("%d points: KNearest(%v, %d, %v) item %d is %v away, want %v", n, target, k, radius, i, math.Sqrt(got), math.Sqrt(want))
+				}
+			}
+			wantRadius := radius
+			if len(want) == k {
+				wantRadius = math.Sqrt(geometry.Vec3(want[k-1]).Distance2(target))
+			}
+			if found != wantRadius {
+				t.Fatalf("%d points: KNearest(%v, %d, %v) radius is %v, want %v", n, target, k, radius, found, wantRadius)
+			}
+		}
+	}
+}
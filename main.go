@@ -1,24 +1,32 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/BenLubar/goray/geometry"
+	"github.com/BenLubar/goray/hdr"
 	"github.com/BenLubar/goray/render"
 	"image/png"
+	"io"
 	"log"
 	"math"
-	"math/rand"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 )
 
 var (
 	input    = flag.String("i", "default.scene", "The file describing the scene")
 	cores    = flag.Int("cores", 2, "The number of cores to use on the machine")
-	chunks   = flag.Int("chunks", 8, "The number of chunks to use for parallelism")
+	tileSize = flag.Int("tile", 16, "The width and height in pixels of the tiles rendered in parallel")
+	order    = flag.String("order", "spiral", "The order in which tiles are rendered: spiral, hilbert or scanline")
 	fps      = flag.Int("fps", 60, "Frames per second of animation")
+	duration = flag.Float64("duration", 0, "The seconds of animation to render, 0 for up to the last keyframe of the scene")
 	fov      = flag.Int("fov", 75, "The field of view of the rendered image")
 	cols     = flag.Int("w", 800, "The width in pixels of the rendered image")
 	rows     = flag.Int("h", 600, "The height in pixels of the rendered image")
@@ -30,6 +38,19 @@ var (
 	caustics = flag.Int("caustics", -1, "The depth of the caustic photon tracing before the render")
 	gamma    = flag.Float64("gamma", 2.2, "The factor to use for gamma correction")
 
+	photons       = flag.Int("photons", 16, "The factor of the diffuse photon tracing before the render")
+	photonRadius  = flag.Float64("photonradius", 0, "Estimate indirect diffuse light from the photons within this radius instead of path tracing it")
+	finalGather   = flag.Int("gather", 0, "The number of final gather rays used with -photonradius")
+	nearest       = flag.Int("nearest", 0, "The number of nearest photons used to estimate diffuse and caustic light, 0 for all within the radius")
+	causticRadius = flag.Float64("causticradius", 0.1, "The radius of the caustic photon estimate")
+
+	filter       = flag.String("filter", "box", "The pixel reconstruction filter: box, tent, gaussian, mitchell or lanczos")
+	filterRadius = flag.Float64("filterradius", 0, "The radius in pixels of the reconstruction filter, 0 for the usual radius of the filter")
+
+	aovs           = flag.String("aov", "", "Comma separated extra passes to render: depth, normal, albedo, object, direct, indirect, caustic")
+	exrType        = flag.String("exrtype", "half", "The pixel type of OpenEXR output: half or float")
+	exrCompression = flag.String("exrcompression", "zip", "The compression of OpenEXR output: zip or none")
+
 	skipTop    = flag.Int("skiptop", 0, "The number of pixels to skip calculating starting from the top of the image")
 	skipLeft   = flag.Int("skipleft", 0, "The number of pixels to skip calculating starting from the left side of the image")
 	skipRight  = flag.Int("skipright", 0, "The number of pixels to skip calculating starting from the right side of the image")
@@ -40,21 +61,102 @@ var (
 	memprofile = flag.String("memprofile", "", "Write memory profile informaion to file")
 )
 
+// Writes the rendered image in the format matching the file extension:
+// OpenEXR, Radiance RGBE or PFM keep the full dynamic range, anything else
+// is tone mapped and written as PNG. AOV passes are stored as layers of an
+// OpenEXR image, or as separate PFM files otherwise.
+func writeImage(filename string, renderer *render.Renderer, fb *render.Framebuffer) error {
+	ext := filepath.Ext(filename)
+	if strings.ToLower(ext) != ".exr" {
+		for a, pass := range fb.Passes {
+			write := hdr.WritePFM
+			if a.Scalar() {
+				write = hdr.WriteGrayPFM
+			}
+			if err := writeFile(strings.TrimSuffix(filename, ext)+"."+a.String()+".pfm", pass, write); err != nil {
+				return err
+			}
+		}
+	}
+
+	return writeFile(filename, fb, func(w io.Writer, fb *render.Framebuffer) error {
+		switch strings.ToLower(ext) {
+		case ".exr":
+			pixelType, compression := hdr.Half, hdr.ZIPCompression
+			if *exrType == "float" {
+				pixelType = hdr.Float
+			}
+			if *exrCompression == "none" {
+				compression = hdr.NoCompression
+			}
+			return hdr.WriteEXR(w, fb, pixelType, compression)
+		case ".hdr":
+			return hdr.WriteRGBE(w, fb)
+		case ".pfm":
+			return hdr.WritePFM(w, fb)
+		}
+		return png.Encode(w, renderer.ToneMap(fb))
+	})
+}
+
+func writeFile(filename string, fb *render.Framebuffer, write func(io.Writer, *render.Framebuffer) error) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err = write(file, fb); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Prints progress on a single terminal line per phase.
+func printProgress(p render.Progress) {
+	percent := 100.0
+	if p.Total != 0 {
+		percent = 100 * float64(p.Done) / float64(p.Total)
+	}
+	fmt.Printf("\r\x1b[K%v %6.2f%%", p.Phase, percent)
+	if p.Done == p.Total {
+		fmt.Printf(" took %v\n", p.Elapsed)
+	} else if p.Done != 0 {
+		fmt.Printf(" (Time Remaining: %v)", p.Remaining)
+	}
+}
+
 func main() {
 	flag.Parse()
 
-	rand.Seed(*seed)
+	var options render.Options
+	options.NumRays = *rays
+	options.Caustics = *caustics
+	options.BloomFactor = *bloom
+	options.MinDepth = *mindepth
+	options.GammaFactor = *gamma
+	options.Seed = *seed
+	options.DiffusePhotons = *photons
+	options.PhotonRadius = *photonRadius
+	options.FinalGather = *finalGather
+	options.EstimatePhotons = *nearest
+	options.CausticRadius = *causticRadius
+	options.Progress = printProgress
 
-	render.Config.NumRays = *rays
-	render.Config.Caustics = *caustics
-	render.Config.BloomFactor = *bloom
-	render.Config.MinDepth = *mindepth
-	render.Config.GammaFactor = *gamma
+	if *aovs != "" {
+		for _, name := range strings.Split(*aovs, ",") {
+			a, ok := render.ParseAOV(strings.TrimSpace(name))
+			if !ok {
+				log.Fatalf("Unknown AOV %q", name)
+			}
+			options.AOVs = append(options.AOVs, a)
+		}
+	}
 
-	render.Config.Skip.Top = *skipTop
-	render.Config.Skip.Left = *skipLeft
-	render.Config.Skip.Right = *skipRight
-	render.Config.Skip.Bottom = *skipBottom
+	options.Skip.Top = *skipTop
+	options.Skip.Left = *skipLeft
+	options.Skip.Right = *skipRight
+	options.Skip.Bottom = *skipBottom
 
 	wantedCPUs := *cores
 	if wantedCPUs < 1 {
@@ -63,15 +165,21 @@ func main() {
 	fmt.Printf("Running on %v/%v CPU cores\n", wantedCPUs, runtime.NumCPU())
 	runtime.GOMAXPROCS(wantedCPUs)
 
-	if wantedCPUs > *chunks {
-		log.Print("Warning: chunks setting is lower than the number of cores - not all cores will be used")
+	tileOrder, ok := render.ParseTileOrder(*order)
+	if !ok {
+		log.Fatalf("Unknown tile order %q", *order)
 	}
 
-	if *rows%*chunks != 0 {
-		log.Fatal("The images height needs to be evenly divisible by chunks")
+	pixelFilter, ok := render.ParseFilter(*filter)
+	if !ok {
+		log.Fatalf("Unknown filter %q", *filter)
 	}
 
-	render.Config.Chunks = *chunks
+	options.TileSize = *tileSize
+	options.TileOrder = tileOrder
+	options.Filter = pixelFilter
+	options.FilterRadius = *filterRadius
+	renderer := render.New(options)
 
 	if *cpuprofile != "" {
 		cpupf, err := os.Create(*cpuprofile)
@@ -96,25 +204,46 @@ func main() {
 	width := height * float64(*cols) / float64(*rows) // Aspect ratio?
 	angle := math.Pi * float64(*fov) / 180.0
 
-	scene := geometry.ParseScene(*input, width, height, angle, *cols, *rows)
-
-	const x_shift = 5
-	for i := 0; i <= 2*x_shift**fps; i++ {
-		scene.Camera.X = -(float64(i)/float64(*fps) - x_shift)
+	scene, err := geometry.ParseScene(*input, width, height, angle, *cols, *rows)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		img := render.Render(scene)
+	// Stop rendering cleanly on ^C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-		file, err := os.Create(fmt.Sprintf(*output, i))
-		if err != nil {
+	// Render every frame of the scene's animation, or a single frame if
+	// it is not animated. Moving shapes and cameras keep going forever, so
+	// they are only animated for the given duration.
+	seconds := *duration
+	if seconds <= 0 {
+		seconds = scene.Animation.Duration()
+	}
+	frames := 1
+	if seconds > 0 {
+		frames = int(math.Round(seconds*float64(*fps))) + 1
+	}
+	for i := 0; i < frames; i++ {
+		fb, err := renderer.Render(ctx, scene.Frame(float64(i)/float64(*fps)))
+		// A cancelled frame is written as far as it got
+		canceled := errors.Is(err, context.Canceled)
+		if err != nil && !canceled {
 			log.Fatal(err)
 		}
 
-		if err = png.Encode(file, img); err != nil {
-			log.Fatal(err)
+		if fb != nil {
+			filename := *output
+			if strings.Contains(filename, "%") {
+				filename = fmt.Sprintf(filename, i)
+			}
+			if err := writeImage(filename, renderer, fb); err != nil {
+				log.Fatal(err)
+			}
 		}
-
-		if err = file.Close(); err != nil {
-			log.Fatal(err)
+		if canceled {
+			fmt.Println("Interrupted")
+			break
 		}
 	}
 
@@ -0,0 +1,118 @@
+package render
+
+import (
+	"github.com/BenLubar/goray/geometry"
+	"math"
+)
+
+// An arbitrary output variable: an extra pass rendered alongside the
+// image, describing what the camera rays hit.
+type AOV int
+
+const (
+	// Distance from the camera along its viewing direction
+	Depth AOV = iota
+	// Shading normal of the surface, facing the camera
+	Normal
+	// Color of the surface
+	Albedo
+	// Index of the shape in Scene.Objects, -1 for the background
+	ObjectID
+	// Emission of the surface and light reaching it directly from emitters
+	Direct
+	// Light reaching the surface by bouncing off other surfaces, and any
+	// light seen through mirrors and glass
+	Indirect
+	// Light reaching the surface from the caustics photon map
+	Caustic
+
+	numAOVs = int(Caustic) + 1
+)
+
+var aovNames = map[AOV]string{
+	Depth:    "depth",
+	Normal:   "normal",
+	Albedo:   "albedo",
+	ObjectID: "object",
+	Direct:   "direct",
+	Indirect: "indirect",
+	Caustic:  "caustic",
+}
+
+func (a AOV) String() string {
+	return aovNames[a]
+}
+
+// Scalar passes only use the X component of their framebuffer.
+func (a AOV) Scalar() bool {
+	return a == Depth || a == ObjectID
+}
+
+// Looks up an AOV by its name as returned by String.
+func ParseAOV(name string) (AOV, bool) {
+	for a, n := range aovNames {
+		if n == name {
+			return a, true
+		}
+	}
+	return 0, false
+}
+
+// The first surface hit by a camera ray and how the light leaving it
+// splits up. Direct and caustic are only set for diffuse surfaces.
+type surfaceHit struct {
+	shape           *geometry.Shape
+	distance        float64
+	normal          geometry.Vec3
+	direct, caustic geometry.Vec3
+}
+
+// Accumulates the AOVs of every sample of one pixel.
+type aovPixel struct {
+	values [numAOVs]geometry.Vec3
+	hits   int
+	first  bool
+}
+
+func (p *aovPixel) add(r *Renderer, hit *surfaceHit, color geometry.Vec3, axis, direction geometry.Vec3) {
+	if !p.first {
+		p.first = true
+		p.values[ObjectID].X = -1
+		if hit.shape != nil {
+			p.values[ObjectID].X = float64(r.objectIndex[hit.shape])
+		}
+	}
+	if hit.shape == nil {
+		p.values[Indirect].AddInPlace(color)
+		return
+	}
+
+	p.hits++
+	p.values[Depth].X += hit.distance * direction.Dot(axis)
+	p.values[Normal].AddInPlace(hit.normal)
+	p.values[Albedo].AddInPlace(hit.shape.Color)
+	p.values[Direct].AddInPlace(hit.direct)
+	p.values[Caustic].AddInPlace(hit.caustic)
+	p.values[Indirect].AddInPlace(color.Sub(hit.direct).Sub(hit.caustic))
+}
+
+// Averages the surface properties over the samples that hit something and
+// the light contributions over all samples.
+func (p *aovPixel) result(samples int) []geometry.Vec3 {
+	values := p.values
+	if !p.first {
+		values[ObjectID].X = -1
+	}
+	if p.hits == 0 {
+		values[Depth].X = math.Inf(+1)
+	} else {
+		hits := 1.0 / float64(p.hits)
+		values[Depth] = values[Depth].Mult(hits)
+		values[Normal] = values[Normal].Mult(hits)
+		values[Albedo] = values[Albedo].Mult(hits)
+	}
+	for _, a := range []AOV{Direct, Indirect, Caustic} {
+		values[a] = values[a].Mult(1.0 / float64(samples))
+	}
+	return values[:]
+}
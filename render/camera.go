@@ -0,0 +1,177 @@
+package render
+
+import (
+	"github.com/BenLubar/goray/geometry"
+	"math"
+	"math/rand"
+)
+
+// The camera of a scene with its directions worked out once per tile.
+type view struct {
+	camera             *geometry.Camera
+	right, up, forward geometry.Vec3
+	focus              float64
+	scene              *geometry.Scene
+}
+
+func newView(scene *geometry.Scene) *view {
+	right, up, forward := scene.CameraBasis()
+	return &view{&scene.Camera, right, up, forward, scene.Camera.Focus(), scene}
+}
+
+// How many separate views the image of camera is split into, across and
+// down: the eyes of a stereo camera and the faces of a cubemap.
+func views(camera *geometry.Camera) (across, down int) {
+	across, down = 1, 1
+	if camera.Projection == geometry.CUBEMAP {
+		across, down = 3, 2
+	}
+	switch camera.Stereo {
+	case geometry.SIDE_BY_SIDE:
+		across *= 2
+	case geometry.OVER_UNDER:
+		down *= 2
+	}
+	return across, down
+}
+
+// The ray at time through the point (x, y) of the image, in pixels from
+// the top left corner, and the direction depth is measured along, which is
+// the ray itself for the fisheye and panoramic projections. ok is false if
+// the point is outside of the image circle of a fisheye camera.
+func (v *view) ray(x, y, time float64, rand *rand.Rand) (ray geometry.Ray, axis geometry.Vec3, ok bool) {
+	// Stereo cameras split the image between the eyes, left or top first
+	cols, rows := float64(v.scene.Cols), float64(v.scene.Rows)
+	eye := 0.0
+	switch v.camera.Stereo {
+	case geometry.SIDE_BY_SIDE:
+		cols /= 2
+		eye = -1
+		if x >= cols {
+			x -= cols
+			eye = 1
+		}
+	case geometry.OVER_UNDER:
+		rows /= 2
+		eye = -1
+		if y >= rows {
+			y -= rows
+			eye = 1
+		}
+	}
+
+	// Both from -1 to 1, with b going up
+	a, b := 2*x/cols-1, 1-2*y/rows
+	ray, axis, ok = v.project(a, b, cols, rows)
+	if !ok {
+		return ray, axis, ok
+	}
+	ray.Time = time
+	ray.Origin = ray.Origin.Add(v.camera.Velocity.Mult(time))
+
+	if eye != 0 {
+		ray = v.eye(ray, axis, eye)
+	}
+
+	// Thin lens: rays from every point of the aperture meet on the plane
+	// in focus
+	if v.camera.Projection == geometry.PERSPECTIVE && v.camera.Aperture > 0 {
+		target := ray.Origin.Add(ray.Direction.Mult(v.focus / ray.Direction.Dot(v.forward)))
+		lu, lv := v.camera.SampleAperture(rand.Float64(), rand.Float64(), rand.Float64())
+		ray.Origin = ray.Origin.Add(v.right.Mult(lu)).Add(v.up.Mult(lv))
+		ray.Direction = target.Sub(ray.Origin).Normalize()
+	}
+	return ray, axis, true
+}
+
+// The ray of the camera through the point (a, b) of an image cols by rows
+// pixels, both from -1 to 1 with b going up.
+func (v *view) project(a, b, cols, rows float64) (geometry.Ray, geometry.Vec3, bool) {
+	origin := v.camera.Position
+
+	switch v.camera.Projection {
+	case geometry.ORTHOGRAPHIC:
+		width := v.camera.ViewWidth / 2
+		height := width * rows / cols
+		origin = origin.Add(v.right.Mult(a * width)).Add(v.up.Mult(b * height))
+		return geometry.Ray{origin, v.forward, 0}, v.forward, true
+	case geometry.FISHEYE:
+		shorter := math.Min(cols, rows)
+		a *= cols / shorter
+		b *= rows / shorter
+		r := math.Sqrt(a*a + b*b)
+		if r > 1 {
+			return geometry.Ray{}, geometry.Vec3{}, false
+		}
+		angle := v.camera.Angle
+		if angle == 0 {
+			angle = 180
+		}
+		theta := r * angle * math.Pi / 360
+		sin := math.Sin(theta)
+		direction := v.forward.Mult(math.Cos(theta))
+		if r > 0 {
+			direction = direction.Add(v.right.Mult(sin * a / r)).Add(v.up.Mult(sin * b / r)).Normalize()
+		}
+		return geometry.Ray{origin, direction, 0}, direction, true
+	case geometry.EQUIRECTANGULAR:
+		longitude, latitude := a*math.Pi, b*math.Pi/2
+		direction := v.forward.Mult(math.Cos(latitude) * math.Cos(longitude)).
+			Add(v.right.Mult(math.Cos(latitude) * math.Sin(longitude))).
+			Add(v.up.Mult(math.Sin(latitude))).Normalize()
+		return geometry.Ray{origin, direction, 0}, direction, true
+	case geometry.CUBEMAP:
+		// Each face is a 90 degree perspective view
+		col := math.Min(math.Floor((a+1)*1.5), 2)
+		row := math.Min(math.Floor(1-b), 1)
+		a = (a+1)*3 - 2*col - 1
+		b = 1 - ((1-b)*2 - 2*row)
+		forward, right, up := v.forward, v.right, v.up
+		switch int(row)*3 + int(col) {
+		case 0:
+			forward, right = v.right, v.forward.Mult(-1)
+		case 1:
+			forward, right = v.right.Mult(-1), v.forward
+		case 2:
+			forward, up = v.up, v.forward.Mult(-1)
+		case 3:
+			forward, up = v.up.Mult(-1), v.forward
+		case 5:
+			forward, right = v.forward.Mult(-1), v.right.Mult(-1)
+		}
+		direction := forward.Add(right.Mult(a)).Add(up.Mult(b)).Normalize()
+		return geometry.Ray{origin, direction, 0}, forward, true
+	}
+
+	// The vertical field of view is kept and the width follows the
+	// aspect ratio, which differs from the scene's for stereo images.
+	height := v.scene.Height
+	width := height * cols / rows
+	direction := v.right.Mult(a * width).Add(v.up.Mult(b * height)).Add(v.forward.Mult(v.scene.Near)).Normalize()
+	return geometry.Ray{origin, direction, 0}, v.forward, true
+}
+
+// Moves a ray of the camera to the left (eye -1) or right (eye 1) eye.
+// The eyes of fisheye, equirectangular and cubemap cameras circle its
+// position, so that every direction is seen by eyes side by side
+// (omni-directional stereo). With Convergence the ray is turned to meet
+// the ray of the other eye at that distance along axis.
+func (v *view) eye(ray geometry.Ray, axis geometry.Vec3, eye float64) geometry.Ray {
+	side := v.right
+	if v.camera.Projection != geometry.PERSPECTIVE && v.camera.Projection != geometry.ORTHOGRAPHIC {
+		side = v.up.Cross(ray.Direction)
+		if side.IsZero() {
+			// Straight up or down both eyes see the same
+			return ray
+		}
+		side = side.Normalize()
+	}
+
+	center := ray.Origin
+	ray.Origin = center.Add(side.Mult(eye * v.camera.EyeDistance() / 2))
+	if v.camera.Convergence > 0 {
+		target := center.Add(ray.Direction.Mult(v.camera.Convergence / ray.Direction.Dot(axis)))
+		ray.Direction = target.Sub(ray.Origin).Normalize()
+	}
+	return ray
+}
@@ -0,0 +1,197 @@
+package render
+
+import (
+	"github.com/BenLubar/goray/geometry"
+	"image"
+	"math"
+)
+
+// The reconstruction filter weighing the samples around every pixel.
+type Filter int
+
+const (
+	// Every sample within the radius counts the same
+	BoxFilter Filter = iota
+	// Falling off linearly towards the radius
+	TentFilter
+	// A Gaussian bell cut off at the radius
+	GaussianFilter
+	// The Mitchell-Netravali cubic with B = C = 1/3
+	MitchellFilter
+	// A sinc windowed by a wider sinc, with one lobe per pixel of radius
+	LanczosFilter
+)
+
+var filters = map[string]Filter{
+	"box":      BoxFilter,
+	"tent":     TentFilter,
+	"gaussian": GaussianFilter,
+	"mitchell": MitchellFilter,
+	"lanczos":  LanczosFilter,
+}
+
+// Looks up a filter by its lower case name.
+func ParseFilter(name string) (Filter, bool) {
+	filter, ok := filters[name]
+	return filter, ok
+}
+
+// The radius in pixels the filter is usually used with. The box filter
+// covers exactly one pixel, like the plain average of its samples.
+func (f Filter) DefaultRadius() float64 {
+	switch f {
+	case TentFilter:
+		return 1
+	case GaussianFilter:
+		return 1.5
+	case MitchellFilter:
+		return 2
+	case LanczosFilter:
+		return 3
+	}
+	return 0.5
+}
+
+// The weight of a sample x pixels from the center of a pixel along one
+// axis. The filters are separable, so the weight of a sample is the
+// product of the weights along both axes.
+func (f Filter) weight(x, radius float64) float64 {
+	x = math.Abs(x)
+	if x > radius {
+		return 0
+	}
+	switch f {
+	case TentFilter:
+		return radius - x
+	case GaussianFilter:
+		const alpha = 2
+		return math.Exp(-alpha*x*x) - math.Exp(-alpha*radius*radius)
+	case MitchellFilter:
+		const b, c = 1.0 / 3, 1.0 / 3
+		x *= 2 / radius
+		if x > 1 {
+			return ((-b-6*c)*x*x*x + (6*b+30*c)*x*x + (-12*b-48*c)*x + (8*b + 24*c)) / 6
+		}
+		return ((12-9*b-6*c)*x*x*x + (-18+12*b+6*c)*x*x + (6 - 2*b)) / 6
+	case LanczosFilter:
+		return sinc(x) * sinc(x/radius)
+	}
+	return 1
+}
+
+func sinc(x float64) float64 {
+	if x < 1e-5 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// Collects the samples of an image. Every sample is added to each pixel
+// whose center is within the radius of the filter, weighted by it. The
+// workers fill in separate tiles, which are merged in the tile order once
+// every tile is done, so the image does not depend on which worker
+// rendered what.
+//
+// The image may be split evenly into across by down separate views, such
+// as the eyes of a stereo camera, and samples are only added to pixels of
+// their own view. Pixels outside of visible stay black.
+type film struct {
+	width, height int
+	across, down  int
+	visible       image.Rectangle
+	filter        Filter
+	radius        float64
+	tiles         []*filmTile
+}
+
+// The samples added to the pixels around one tile.
+type filmTile struct {
+	film   *film
+	bounds image.Rectangle
+	color  []geometry.Vec3
+	weight []float64
+}
+
+func newFilm(width, height, across, down int, visible image.Rectangle, filter Filter, radius float64, tiles int) *film {
+	if radius <= 0 {
+		radius = filter.DefaultRadius()
+	}
+	return &film{width, height, across, down, visible, filter, radius, make([]*filmTile, tiles)}
+}
+
+// Stores a new tile for the samples of the pixels in bounds at index in
+// the tile order. Only one worker may use the tile.
+func (f *film) tile(index int, bounds image.Rectangle) *filmTile {
+	margin := int(math.Ceil(f.radius))
+	bounds = bounds.Inset(-margin).Intersect(image.Rect(0, 0, f.width, f.height))
+	size := bounds.Dx() * bounds.Dy()
+	t := &filmTile{f, bounds, make([]geometry.Vec3, size), make([]float64, size)}
+	f.tiles[index] = t
+	return t
+}
+
+// The first and last pixel along an axis size pixels long, split into
+// parts views, whose centers are in the same view as position p.
+func viewPixels(p float64, size, parts int) (first, last float64) {
+	view := math.Min(math.Floor(p*float64(parts)/float64(size)), float64(parts-1))
+	start := view * float64(size) / float64(parts)
+	end := (view + 1) * float64(size) / float64(parts)
+	return math.Ceil(start - 0.5), math.Ceil(end-0.5) - 1
+}
+
+// Adds a sample at (x, y) in pixels from the top left corner of the image.
+// Pixel centers are half a pixel in.
+func (t *filmTile) add(x, y float64, c geometry.Vec3) {
+	f := t.film
+	left, right := viewPixels(x, f.width, f.across)
+	top, bottom := viewPixels(y, f.height, f.down)
+	x, y = x-0.5, y-0.5
+	x0 := int(math.Max(math.Max(math.Ceil(x-f.radius), left), float64(t.bounds.Min.X)))
+	x1 := int(math.Min(math.Min(math.Floor(x+f.radius), right), float64(t.bounds.Max.X-1)))
+	y0 := int(math.Max(math.Max(math.Ceil(y-f.radius), top), float64(t.bounds.Min.Y)))
+	y1 := int(math.Min(math.Min(math.Floor(y+f.radius), bottom), float64(t.bounds.Max.Y-1)))
+
+	for py := y0; py <= y1; py++ {
+		wy := f.filter.weight(y-float64(py), f.radius)
+		if wy == 0 {
+			continue
+		}
+		row := (py - t.bounds.Min.Y) * t.bounds.Dx()
+		for px := x0; px <= x1; px++ {
+			w := wy * f.filter.weight(x-float64(px), f.radius)
+			if w == 0 {
+				continue
+			}
+			i := row + px - t.bounds.Min.X
+			t.color[i].AddInPlace(c.Mult(w))
+			t.weight[i] += w
+		}
+	}
+}
+
+// Merges the tiles and stores the filtered color of every visible pixel in
+// fb. Pixels without samples are black.
+func (f *film) develop(fb *Framebuffer) {
+	color := make([]geometry.Vec3, f.width*f.height)
+	weight := make([]float64, f.width*f.height)
+	for _, t := range f.tiles {
+		if t == nil {
+			continue
+		}
+		for y := t.bounds.Min.Y; y < t.bounds.Max.Y; y++ {
+			for x := t.bounds.Min.X; x < t.bounds.Max.X; x++ {
+				i := (y-t.bounds.Min.Y)*t.bounds.Dx() + x - t.bounds.Min.X
+				color[y*f.width+x].AddInPlace(t.color[i])
+				weight[y*f.width+x] += t.weight[i]
+			}
+		}
+	}
+	for y := f.visible.Min.Y; y < f.visible.Max.Y; y++ {
+		for x := f.visible.Min.X; x < f.visible.Max.X; x++ {
+			// The negative lobes of some filters can cancel out
+			if i := y*f.width + x; weight[i] > 1e-9 {
+				fb.Pix[i] = color[i].Mult(1 / weight[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package render
+
+import (
+	"github.com/BenLubar/goray/geometry"
+)
+
+// The linear radiance of every pixel of a rendered image, before any
+// clamping, bloom or gamma correction. Pixels are stored row by row
+// starting at the top left. Passes holds the AOVs requested in Options.
+type Framebuffer struct {
+	Width, Height int
+	Pix           []geometry.Vec3
+	Passes        map[AOV]*Framebuffer
+}
+
+func NewFramebuffer(width, height int) *Framebuffer {
+	return &Framebuffer{width, height, make([]geometry.Vec3, width*height), nil}
+}
+
+func (fb *Framebuffer) At(x, y int) geometry.Vec3 {
+	return fb.Pix[y*fb.Width+x]
+}
+
+func (fb *Framebuffer) Set(x, y int, c geometry.Vec3) {
+	fb.Pix[y*fb.Width+x] = c
+}
@@ -0,0 +1,99 @@
+package render
+
+import (
+	"github.com/BenLubar/goray/geometry"
+	"math"
+)
+
+// The share of light reflected when going from a medium with index of
+// refraction n1 into one with n2, hitting the surface at an angle with
+// cosine cosI. Light that cannot enter the second medium is reflected in
+// full.
+func Fresnel(model geometry.FresnelModel, cosI, n1, n2 float64) float64 {
+	sinT2 := (n1 / n2) * (n1 / n2) * (1 - cosI*cosI)
+	if sinT2 >= 1 {
+		// Total internal reflection
+		return 1
+	}
+	cosT := math.Sqrt(1 - sinT2)
+
+	if model == geometry.SCHLICK {
+		r0 := (n1 - n2) / (n1 + n2)
+		r0 *= r0
+		// Use the angle in the optically thinner medium
+		cos := cosI
+		if n1 > n2 {
+			cos = cosT
+		}
+		return r0 + (1-r0)*math.Pow(1-cos, 5)
+	}
+
+	rs := (n1*cosI - n2*cosT) / (n1*cosI + n2*cosT)
+	rp := (n1*cosT - n2*cosI) / (n1*cosT + n2*cosI)
+	return (rs*rs + rp*rp) / 2
+}
+
+// The index of refraction of a refractive shape.
+func IOR(shape *geometry.Shape) float64 {
+	if shape.IOR == 0 {
+		return GLASS
+	}
+	return shape.IOR
+}
+
+// The refractive shapes a ray is inside of, innermost last. Media are
+// never modified, entering or leaving a shape returns a new stack.
+type media []*geometry.Shape
+
+// The index of refraction of the innermost medium.
+func (m media) ior() float64 {
+	if len(m) == 0 {
+		return AIR
+	}
+	return IOR(m[len(m)-1])
+}
+
+func (m media) enter(shape *geometry.Shape) media {
+	return append(m[:len(m):len(m)], shape)
+}
+
+// Leaving a shape that is not the innermost medium, as when overlapping
+// shapes do not nest, removes it from wherever it is in the stack.
+func (m media) leave(shape *geometry.Shape) media {
+	for i := len(m) - 1; i >= 0; i-- {
+		if m[i] == shape {
+			return append(m[:i:i], m[i+1:]...)
+		}
+	}
+	return m
+}
+
+// Where a ray hitting a refractive shape goes. Returns the indices of
+// refraction on both sides of the surface, the media the transmitted ray
+// is in, and the share of light reflected.
+func (m media) refract(shape *geometry.Shape, normal, outgoing, direction geometry.Vec3) (n1, n2 float64, inner media, R float64) {
+	if normal.Dot(outgoing) < 0 {
+		// Leave the shape
+		inner = m.leave(shape)
+		n1, n2 = IOR(shape), inner.ior()
+	} else {
+		inner = m.enter(shape)
+		n1, n2 = m.ior(), IOR(shape)
+	}
+	return n1, n2, inner, Fresnel(shape.Fresnel, -outgoing.Dot(direction), n1, n2)
+}
+
+// The direction of a ray going from a medium with index of refraction n1
+// into one with n2 through a surface facing outgoing. Only valid if it is
+// not totally reflected.
+func refractDirection(direction, outgoing geometry.Vec3, n1, n2 float64) geometry.Vec3 {
+	eta := n1 / n2
+	cosI := -outgoing.Dot(direction)
+	cosT := math.Sqrt(math.Max(1-eta*eta*(1-cosI*cosI), 0))
+	return direction.Mult(eta).Add(outgoing.Mult(eta*cosI - cosT)).Normalize()
+}
+
+// The mirror image of direction at a surface facing normal.
+func reflectDirection(direction, normal geometry.Vec3) geometry.Vec3 {
+	return direction.Sub(normal.Mult(2 * normal.Dot(direction))).Normalize()
+}
@@ -1,35 +1,23 @@
 package render
 
 import (
-	"fmt"
+	"context"
+	"github.com/BenLubar/goray/bvh"
 	"github.com/BenLubar/goray/geometry"
 	"github.com/BenLubar/goray/kd"
 	"image"
 	"image/color"
 	"math"
 	"math/rand"
+	"runtime"
+	"sync"
 	"time"
 )
 
-func clearLine() {
-	fmt.Print("\r\x1b[K")
-}
-
-func ClosestIntersection(shapes []*geometry.Shape, ray geometry.Ray) (*geometry.Shape, float64) {
-	var closest *geometry.Shape
-	bestHit := math.Inf(+1)
-	for _, shape := range shapes {
-		if hit := shape.Intersects(ray); hit > 1e-15 && hit < bestHit {
-			bestHit = hit
-			closest = shape
-		}
-	}
-	return closest, bestHit
-}
-
+// A pixel whose samples have all been added to the film, with its AOVs.
 type Result struct {
-	x, y  int
-	color geometry.Vec3
+	x, y   int
+	passes []geometry.Vec3
 }
 
 const (
@@ -37,42 +25,68 @@ const (
 	GLASS = 1.5
 )
 
-func MonteCarloPixel(results chan Result, scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, start, rows int, rand *rand.Rand) {
-	samples := Config.NumRays
+// Traces the samples of the pixels in bounds and adds them to tile.
+func (r *Renderer) MonteCarloPixel(ctx context.Context, results chan Result, scene *geometry.Scene, bounds image.Rectangle, tile *filmTile, search *photonSearch, rand *rand.Rand) {
+	samples := r.NumRays
+	path := pathState{search: search}
+	view := newView(scene)
+	shutter := scene.Camera.Shutter()
 
-	for y := start; y < start+rows; y++ {
-		py := scene.Height - scene.Height*2*float64(y)/float64(scene.Rows)
-		for x := 0; x < scene.Cols; x++ {
-			px := -scene.Width + scene.Width*2*float64(x)/float64(scene.Cols)
-			var colorSamples geometry.Vec3
-			if x >= Config.Skip.Left && x < scene.Cols-Config.Skip.Right &&
-				y >= Config.Skip.Top && y < scene.Rows-Config.Skip.Bottom {
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if ctx.Err() != nil {
+			return
+		}
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var aovs aovPixel
+			if x >= r.Skip.Left && x < scene.Cols-r.Skip.Right &&
+				y >= r.Skip.Top && y < scene.Rows-r.Skip.Bottom {
 				for sample := 0; sample < samples; sample++ {
-					dy, dx := rand.Float64()*scene.PixH, rand.Float64()*scene.PixW
-					direction := geometry.Vec3{
-						px + dx,
-						py + dy,
-						scene.Near,
-					}.Normalize()
-					direction = geometry.PitchYawRollVector(scene.Pitch, scene.Yaw, scene.Roll, direction)
-
-					contribution := Radiance(geometry.Ray{scene.Camera, direction}, scene, diffuseMap, causticsMap, 0, 1.0, rand)
-					colorSamples.AddInPlace(contribution)
+					dy, dx := rand.Float64(), rand.Float64()
+					var time float64
+					if shutter > 0 {
+						time = rand.Float64() * shutter
+					}
+					sx, sy := float64(x)+dx, float64(y)+dy
+					ray, axis, ok := view.ray(sx, sy, time, rand)
+					if !ok {
+						tile.add(sx, sy, geometry.Vec3{})
+						continue
+					}
+
+					if len(r.AOVs) == 0 {
+						contribution := r.radiance(ray, scene, 0, 1.0, rand, nil, path)
+						tile.add(sx, sy, contribution)
+						continue
+					}
+
+					var hit surfaceHit
+					contribution := r.radiance(ray, scene, 0, 1.0, rand, &hit, path)
+					tile.add(sx, sy, contribution)
+					aovs.add(r, &hit, contribution, axis, ray.Direction)
 				}
 			}
-			results <- Result{x, y, colorSamples.Mult(1.0 / float64(samples))}
+
+			var passes []geometry.Vec3
+			if len(r.AOVs) != 0 {
+				passes = aovs.result(samples)
+			}
+			select {
+			case results <- Result{x, y, passes}:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 }
 
-func CorrectColor(x float64) float64 {
-	return math.Pow(x, 1.0/Config.GammaFactor)*255 + 0.5
+func (r *Renderer) CorrectColor(x float64) float64 {
+	return math.Pow(x, 1.0/r.GammaFactor)*255 + 0.5
 }
 
-func CorrectColors(v geometry.Vec3) geometry.Vec3 {
-	v.X = CorrectColor(v.X)
-	v.Y = CorrectColor(v.Y)
-	v.Z = CorrectColor(v.Z)
+func (r *Renderer) CorrectColors(v geometry.Vec3) geometry.Vec3 {
+	v.X = r.CorrectColor(v.X)
+	v.Y = r.CorrectColor(v.Y)
+	v.Z = r.CorrectColor(v.Z)
 	return v
 }
 
@@ -105,94 +119,180 @@ func BloomFilter(img [][]geometry.Vec3, depth int) [][]geometry.Vec3 {
 				data[y][x] = color.Mult(factor)
 			}
 		}
-		fmt.Printf("\rPost Processing %3.0f%%   \r", 100*float64(iteration)/float64(depth))
 		source, data = data, source
 	}
 	return source
 }
 
-var Config struct {
+type Options struct {
 	MinDepth    int
 	NumRays     int
-	Chunks      int
+	TileSize    int
+	TileOrder   TileOrder
 	GammaFactor float64
 	BloomFactor int
 	Caustics    int
+	Seed        int64
+
+	// Diffuse photons traced per emitter are 2*DiffusePhotons², 16 if
+	// zero.
+	DiffusePhotons int
+	// Estimate indirect diffuse light from the diffuse photons within
+	// PhotonRadius instead of following a bounce ray, if positive.
+	PhotonRadius float64
+	// Number of rays gathering the photon estimate at the first diffuse
+	// surface of a path. Zero uses the estimate at the surface itself.
+	FinalGather int
+	// Use only the EstimatePhotons photons nearest to a surface for the
+	// diffuse and caustic estimates, shrinking their radius where photons
+	// are dense. Zero uses every photon within the radius.
+	EstimatePhotons int
+	// Radius of the caustic photon estimate, 0.1 if zero.
+	CausticRadius float64
+
+	// The reconstruction filter of the image, with a radius in pixels.
+	// Zero uses the usual radius of the filter.
+	Filter       Filter
+	FilterRadius float64
+
+	// Extra passes stored in Framebuffer.Passes
+	AOVs []AOV
+
+	// Called from the goroutine running Render. May be nil.
+	Progress func(Progress)
 
 	Skip struct {
 		Top, Left, Right, Bottom int
 	}
 }
 
-func Render(scene geometry.Scene) image.Image {
-	img := image.NewNRGBA(image.Rect(0, 0, scene.Cols, scene.Rows))
+// A Renderer owns the options and random number generator used for
+// rendering, as well as the acceleration structure and photon maps of the
+// scene being rendered. Separate Renderers can render concurrently, but
+// one Renderer renders only one scene at a time.
+type Renderer struct {
+	Options
+
+	rand        *rand.Rand
+	tree        *bvh.BVH
+	diffuseMap  *kd.Tree[PhotonHit]
+	causticsMap *kd.Tree[PhotonHit]
+	diffuseFlux float64
+	causticFlux float64
+	objectIndex map[*geometry.Shape]int
+}
+
+func New(options Options) *Renderer {
+	return &Renderer{
+		Options: options,
+		rand:    rand.New(rand.NewSource(options.Seed)),
+	}
+}
+
+// Renders the scene, reporting progress to Options.Progress. The result is
+// linear radiance; use ToneMap to turn it into a displayable image. If ctx
+// is cancelled the workers are stopped and ctx.Err() is returned, with the
+// part of the frame rendered so far once the photon maps are done.
+func (r *Renderer) Render(ctx context.Context, scene geometry.Scene) (*Framebuffer, error) {
+	fb := NewFramebuffer(scene.Cols, scene.Rows)
 	pixels := make(chan Result, 128)
 
-	workload := scene.Rows / Config.Chunks
+	if len(r.AOVs) != 0 {
+		fb.Passes = make(map[AOV]*Framebuffer, len(r.AOVs))
+		for _, a := range r.AOVs {
+			fb.Passes[a] = NewFramebuffer(scene.Cols, scene.Rows)
+		}
+	}
+	r.objectIndex = make(map[*geometry.Shape]int, len(scene.Objects))
+	for i, shape := range scene.Objects {
+		r.objectIndex[shape] = i
+	}
 
-	startTime := time.Now()
-	globals, caustics := GenerateMaps(scene.Objects)
-	fmt.Println(" Done!")
-	fmt.Printf("Diffuse Map depth: %v Caustics Map depth: %v\n", globals.Depth(), caustics.Depth())
-	fmt.Printf("Photon Maps Done. Generation took: %v\n", time.Since(startTime))
-
-	startTime = time.Now()
-	for y := 0; y < scene.Rows; y += workload {
-		go MonteCarloPixel(pixels, &scene, globals, caustics, y, workload, rand.New(rand.NewSource(rand.Int63())))
+	r.tree = bvh.New(scene.Objects, scene.Camera.Shutter())
+	if err := r.GenerateMaps(ctx, &scene); err != nil {
+		return nil, err
 	}
 
-	// Write targets for after effects
-	data := make([][]geometry.Vec3, scene.Rows)
-	peaks := make([][]geometry.Vec3, scene.Rows)
-	for i, _ := range data {
-		data[i] = make([]geometry.Vec3, scene.Cols)
-		peaks[i] = make([]geometry.Vec3, scene.Cols)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	startTime := time.Now()
+	tiles := makeTiles(scene.Cols, scene.Rows, r.TileSize, r.TileOrder)
+	workers := runtime.GOMAXPROCS(0)
+	queues := newTileQueues(tiles, workers, r.rand)
+	across, down := views(&scene.Camera)
+	visible := image.Rect(r.Skip.Left, r.Skip.Top, scene.Cols-r.Skip.Right, scene.Rows-r.Skip.Bottom)
+	film := newFilm(scene.Cols, scene.Rows, across, down, visible, r.Filter, r.FilterRadius, len(tiles))
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(own int) {
+			defer wg.Done()
+			search := r.newPhotonSearch()
+			for t, ok := nextTile(queues, own); ok; t, ok = nextTile(queues, own) {
+				r.MonteCarloPixel(ctx, pixels, &scene, t.bounds, film.tile(t.index, t.bounds), search, rand.New(rand.NewSource(t.seed)))
+			}
+		}(i)
 	}
 
-	// Collect results
-	var so_far time.Duration
-	var highest, lowest geometry.Vec3
-	highValue, lowValue := 0.0, math.Inf(+1)
+	// Collect results. Every sample of a pixel is on the film before its
+	// result is sent.
 	numPixels := scene.Rows * scene.Cols
 	for i := 0; i < numPixels; i++ {
-		// Print progress information every 500 pixels
-		if i != 0 && i%500 == 0 {
-			fmt.Printf("\rRendering %6.2f%%", 100*float64(i)/float64(scene.Rows*scene.Cols))
-			so_far = time.Since(startTime)
-			remaining := so_far * time.Duration(numPixels-i) / time.Duration(i)
-			fmt.Printf(" (Time Remaining: %v at %0.1f pps)                \r", remaining, float64(i)/so_far.Seconds())
+		// Report progress every 500 pixels
+		if i%500 == 0 {
+			r.report(Rendering, i, numPixels, startTime)
 		}
-		pixel := <-pixels
 
-		if low := pixel.color.Abs(); low < lowValue {
-			lowValue = low
-			lowest = pixel.color
+		var pixel Result
+		select {
+		case pixel = <-pixels:
+		case <-ctx.Done():
+			// The film is complete once every worker has stopped
+			wg.Wait()
+			film.develop(fb)
+			return fb, ctx.Err()
 		}
-		if high := pixel.color.Abs(); high > highValue {
-			highValue = high
-			highest = pixel.color
+
+		for a, pass := range fb.Passes {
+			pass.Set(pixel.x, pixel.y, pixel.passes[a])
 		}
-		data[pixel.y][pixel.x] = pixel.color.CLAMPF()
-		peaks[pixel.y][pixel.x] = pixel.color.PEAKS(0.8)
 	}
-	fmt.Println("\rRendering 100.00%")
+	film.develop(fb)
+	r.report(Rendering, numPixels, numPixels, startTime)
+
+	return fb, nil
+}
 
-	bloomed := BloomFilter(peaks, Config.BloomFactor)
+// Clamps the rendered radiance, adds bloom around the brightest parts and
+// applies gamma correction.
+func (r *Renderer) ToneMap(fb *Framebuffer) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, fb.Width, fb.Height))
+
+	// Write targets for after effects
+	data := make([][]geometry.Vec3, fb.Height)
+	peaks := make([][]geometry.Vec3, fb.Height)
+	for y := range data {
+		data[y] = make([]geometry.Vec3, fb.Width)
+		peaks[y] = make([]geometry.Vec3, fb.Width)
+		for x := range data[y] {
+			data[y][x] = fb.At(x, y).CLAMPF()
+			peaks[y][x] = fb.At(x, y).PEAKS(0.8)
+		}
+	}
+
+	startTime := time.Now()
+	r.report(PostProcessing, 0, r.BloomFactor, startTime)
+	bloomed := BloomFilter(peaks, r.BloomFactor)
+	r.report(PostProcessing, r.BloomFactor, r.BloomFactor, startTime)
 
 	for y := 0; y < len(data); y++ {
 		for x := 0; x < len(data[0]); x++ {
 			c := data[y][x].Add(bloomed[y][x])
-			c = CorrectColors(c).CLAMP()
+			c = r.CorrectColors(c).CLAMP()
 			img.SetNRGBA(x, y, color.NRGBA{uint8(c.X), uint8(c.Y), uint8(c.Z), 255})
 		}
 	}
-	clearLine()
-	fmt.Println("\rDone!")
-	fmt.Printf("Brightest pixel: %v intensity: %v\n", highest, highValue)
-	fmt.Printf("Dimmest pixel: %v intensity: %v\n", lowest, lowValue)
-
-	// Print duration
-	fmt.Printf("Rendering took %v\n", time.Since(startTime))
 
 	return img
 }
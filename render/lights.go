@@ -0,0 +1,50 @@
+package render
+
+import (
+	"github.com/BenLubar/goray/bvh"
+	"github.com/BenLubar/goray/geometry"
+	"math"
+	"math/rand"
+)
+
+// Sums the light arriving at point directly from every light that is not
+// in the shadow of a shape at time, as reflected by a white diffuse surface
+// facing normal.
+func LightSampling(point, normal geometry.Vec3, time float64, lights []*geometry.Light, tree *bvh.BVH, rand *rand.Rand) geometry.Vec3 {
+	var incomingLight geometry.Vec3
+	sampleLights(point, normal, time, lights, tree, rand, func(direction, irradiance geometry.Vec3) {
+		incomingLight.AddInPlace(irradiance.Mult(direction.Dot(normal) / math.Pi))
+	})
+	return incomingLight
+}
+
+// Calls f with the direction towards a point on every light on the side of
+// normal that is not in the shadow of a shape at time, and the irradiance
+// it gives a surface facing it.
+func sampleLights(point, normal geometry.Vec3, time float64, lights []*geometry.Light, tree *bvh.BVH, rand *rand.Rand, f func(direction, irradiance geometry.Vec3)) {
+	for _, light := range lights {
+		direction, distance, irradiance := light.Sample(point, rand.Float64(), rand.Float64())
+		if direction.Dot(normal) <= 0 || irradiance.IsZero() {
+			continue
+		}
+		if object, _, hit := tree.ClosestIntersection(geometry.Ray{point, direction, time}); object != nil && hit < distance-1e-9 {
+			continue
+		}
+		f(direction, irradiance)
+	}
+}
+
+// Photons leave an emitter along the rays returned by an EmitFunc for the
+// index of the photon, with the returned color.
+type EmitFunc func(i int, rand *rand.Rand) (geometry.Ray, geometry.Vec3)
+
+// Emits photons from random points and directions of a light. Directional
+// lights shine on the bounded shapes of the scene only.
+func lightEmitter(light *geometry.Light, tree *bvh.BVH) EmitFunc {
+	min, max, _ := tree.Bounds()
+	center := min.Add(max).Mult(0.5)
+	radius := max.Sub(min).Abs() / 2
+	return func(i int, rand *rand.Rand) (geometry.Ray, geometry.Vec3) {
+		return light.Emit(rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64(), center, radius)
+	}
+}
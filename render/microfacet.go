@@ -0,0 +1,270 @@
+package render
+
+import (
+	"github.com/BenLubar/goray/bvh"
+	"github.com/BenLubar/goray/geometry"
+	"math"
+	"math/rand"
+)
+
+// The GGX microfacet distribution of surfaces with the given roughness
+// alpha, for a microfacet normal making an angle with cosine cos with the
+// surface normal.
+func GGX(cos, alpha float64) float64 {
+	if cos <= 0 {
+		return 0
+	}
+	cos2 := cos * cos
+	tan2 := (1 - cos2) / cos2
+	a2 := alpha * alpha
+	d := a2 + tan2
+	return a2 / (math.Pi * cos2 * cos2 * d * d)
+}
+
+// A random microfacet normal around normal from the GGX distribution with
+// roughness alpha and its density per unit solid angle.
+func GGXLobe(normal geometry.Vec3, alpha float64, rand *rand.Rand) (geometry.Vec3, float64) {
+	u := rand.Float64()
+	tan2 := alpha * alpha * u / (1 - u)
+	cos := 1 / math.Sqrt(1+tan2)
+	half := geometry.AroundNormal(normal, cos, 2*math.Pi*rand.Float64())
+	return half, GGXPdf(normal, half, alpha)
+}
+
+func GGXPdf(normal, half geometry.Vec3, alpha float64) float64 {
+	cos := normal.Dot(half)
+	return GGX(cos, alpha) * math.Max(cos, 0)
+}
+
+// The Beckmann microfacet distribution of surfaces with the given
+// roughness alpha, for a microfacet normal making an angle with cosine cos
+// with the surface normal.
+func Beckmann(cos, alpha float64) float64 {
+	if cos <= 0 {
+		return 0
+	}
+	cos2 := cos * cos
+	tan2 := (1 - cos2) / cos2
+	a2 := alpha * alpha
+	return math.Exp(-tan2/a2) / (math.Pi * a2 * cos2 * cos2)
+}
+
+// A random microfacet normal around normal from the Beckmann distribution
+// with roughness alpha and its density per unit solid angle.
+func BeckmannLobe(normal geometry.Vec3, alpha float64, rand *rand.Rand) (geometry.Vec3, float64) {
+	tan2 := -alpha * alpha * math.Log(1-rand.Float64())
+	cos := 1 / math.Sqrt(1+tan2)
+	half := geometry.AroundNormal(normal, cos, 2*math.Pi*rand.Float64())
+	return half, BeckmannPdf(normal, half, alpha)
+}
+
+func BeckmannPdf(normal, half geometry.Vec3, alpha float64) float64 {
+	cos := normal.Dot(half)
+	return Beckmann(cos, alpha) * math.Max(cos, 0)
+}
+
+// The microfacets of a rough conductor or dielectric.
+type microfacet struct {
+	distribution geometry.Distribution
+	alpha        float64
+}
+
+// Roughness is squared so that it changes the look of a surface evenly.
+func newMicrofacet(shape *geometry.Shape) microfacet {
+	return microfacet{shape.Distribution, math.Max(shape.Roughness*shape.Roughness, 1e-3)}
+}
+
+// The density of microfacet normals making an angle with cosine cos with
+// the surface normal.
+func (m microfacet) d(cos float64) float64 {
+	if m.distribution == geometry.BECKMANN {
+		return Beckmann(cos, m.alpha)
+	}
+	return GGX(cos, m.alpha)
+}
+
+func (m microfacet) sample(normal geometry.Vec3, rand *rand.Rand) geometry.Vec3 {
+	if m.distribution == geometry.BECKMANN {
+		half, _ := BeckmannLobe(normal, m.alpha, rand)
+		return half
+	}
+	half, _ := GGXLobe(normal, m.alpha, rand)
+	return half
+}
+
+// Smith's shadowing term for a direction making an angle with cosine cos
+// with the surface normal.
+func (m microfacet) g1(cos float64) float64 {
+	cos = math.Abs(cos)
+	if cos >= 1 {
+		return 1
+	}
+	tan := math.Sqrt(1-cos*cos) / cos
+	if m.distribution == geometry.BECKMANN {
+		a := 1 / (m.alpha * tan)
+		if a >= 1.6 {
+			return 1
+		}
+		return (3.535*a + 2.181*a*a) / (1 + 2.276*a + 2.577*a*a)
+	}
+	return 2 / (1 + math.Sqrt(1+m.alpha*m.alpha*tan*tan))
+}
+
+// The share of light reflected by a conductor with complex index of
+// refraction eta + ik relative to the medium outside, hit at an angle with
+// cosine cosI.
+func conductorFresnel(cosI, eta, k float64) float64 {
+	cos2 := cosI * cosI
+	sin2 := 1 - cos2
+	t0 := eta*eta - k*k - sin2
+	a2plusb2 := math.Sqrt(t0*t0 + 4*eta*eta*k*k)
+	t1 := a2plusb2 + cos2
+	a := math.Sqrt(math.Max(0.5*(a2plusb2+t0), 0))
+	t2 := 2 * cosI * a
+	rs := (t1 - t2) / (t1 + t2)
+	t3 := cos2*a2plusb2 + sin2*sin2
+	t4 := t2 * sin2
+	rp := rs * (t3 - t4) / (t3 + t4)
+	return (rs + rp) / 2
+}
+
+// The share of light reflected by the microfacets of a shape, hit at an
+// angle with cosine cosI, by color channel. n1 and n2 are the indices of
+// refraction outside and inside a dielectric.
+func microfacetFresnel(shape *geometry.Shape, cosI, n1, n2 float64) geometry.Vec3 {
+	if shape.Material == geometry.DIELECTRIC {
+		f := Fresnel(shape.Fresnel, cosI, n1, n2)
+		return geometry.Vec3{f, f, f}
+	}
+	eta, k := shape.ComplexIOR()
+	return geometry.Vec3{
+		conductorFresnel(cosI, eta.X/n1, k.X/n1),
+		conductorFresnel(cosI, eta.Y/n1, k.Y/n1),
+		conductorFresnel(cosI, eta.Z/n1, k.Z/n1),
+	}
+}
+
+// Where a ray going in direction continues after hitting a rough conductor
+// or dielectric, whose surface normal facing the ray is outgoing. Returns
+// the new direction, the share of the light coming from it that is
+// scattered back along the ray, and the media the new ray is in. The share
+// is zero if the ray is absorbed.
+func scatterMicrofacet(shape *geometry.Shape, m media, normal, outgoing, direction geometry.Vec3, rand *rand.Rand) (geometry.Vec3, geometry.Vec3, media) {
+	mf := newMicrofacet(shape)
+	half := mf.sample(outgoing, rand)
+	reverse := direction.Mult(-1)
+	cosO, cosH, halfO := outgoing.Dot(reverse), outgoing.Dot(half), half.Dot(reverse)
+	if cosO <= 0 || halfO <= 0 {
+		return geometry.Vec3{}, geometry.Vec3{}, m
+	}
+
+	n1, n2, inner := m.ior(), m.ior(), m
+	if shape.Material == geometry.DIELECTRIC {
+		n1, n2, inner, _ = m.refract(shape, normal, outgoing, direction)
+	}
+	fresnel := microfacetFresnel(shape, halfO, n1, n2)
+
+	// Dielectrics either reflect or transmit, chosen by the Fresnel term
+	// so that it cancels out of the weight.
+	if shape.Material == geometry.DIELECTRIC {
+		if rand.Float64() >= fresnel.X {
+			transmitted := refractDirection(direction, half, n1, n2)
+			cosT := outgoing.Dot(transmitted)
+			if cosT >= 0 {
+				return geometry.Vec3{}, geometry.Vec3{}, m
+			}
+			weight := mf.g1(cosO) * mf.g1(cosT) * halfO / (cosO * cosH)
+			return transmitted, geometry.Vec3{weight, weight, weight}, inner
+		}
+		fresnel = geometry.Vec3{1, 1, 1}
+	}
+
+	reflected, weight := mf.reflect(outgoing, half, direction)
+	return reflected, fresnel.Mult(weight), m
+}
+
+// Reflects a ray going in direction off the microfacet with normal half of
+// a surface whose normal facing the ray is outgoing. Returns the new
+// direction and the share of the light coming from it that is reflected,
+// apart from the Fresnel term, which is zero if it goes into the surface.
+func (mf microfacet) reflect(outgoing, half, direction geometry.Vec3) (geometry.Vec3, float64) {
+	reverse := direction.Mult(-1)
+	cosO, cosH, halfO := outgoing.Dot(reverse), outgoing.Dot(half), half.Dot(reverse)
+	reflected := reflectDirection(direction, half)
+	cosI := outgoing.Dot(reflected)
+	if cosO <= 0 || halfO <= 0 || cosI <= 0 {
+		return reflected, 0
+	}
+	return reflected, mf.g1(cosO) * mf.g1(cosI) * halfO / (cosO * cosH)
+}
+
+// The light reflected towards reverse per unit irradiance arriving from
+// toLight, apart from the Fresnel term, and the microfacet normal doing
+// it.
+func (mf microfacet) reflectance(outgoing, reverse, toLight geometry.Vec3) (float64, geometry.Vec3) {
+	half := toLight.Add(reverse).Normalize()
+	cosO, cosI := outgoing.Dot(reverse), outgoing.Dot(toLight)
+	// D G / (4 cosO cosI), times cosI
+	return mf.d(outgoing.Dot(half)) * mf.g1(cosO) * mf.g1(cosI) / (4 * cosO), half
+}
+
+// The light reflected along -direction by the microfacets of a shape from
+// the lights of the scene at time. Only reflection is evaluated, light reaching a
+// dielectric from the other side is left out.
+func reflectLights(shape *geometry.Shape, m media, normal, outgoing, direction, point geometry.Vec3, time float64, lights []*geometry.Light, tree *bvh.BVH, rand *rand.Rand) geometry.Vec3 {
+	mf := newMicrofacet(shape)
+	reverse := direction.Mult(-1)
+	n1, n2 := m.ior(), m.ior()
+	if shape.Material == geometry.DIELECTRIC {
+		n1, n2, _, _ = m.refract(shape, normal, outgoing, direction)
+	}
+
+	var light geometry.Vec3
+	sampleLights(point, outgoing, time, lights, tree, rand, func(toLight, irradiance geometry.Vec3) {
+		f, half := mf.reflectance(outgoing, reverse, toLight)
+		fresnel := microfacetFresnel(shape, half.Dot(reverse), n1, n2)
+		light.AddInPlace(fresnel.MultVec(irradiance).Mult(f))
+	})
+	return light
+}
+
+// The density per unit solid angle of scatterMicrofacet reflecting a ray
+// going in direction towards scattered. Transmission is not sampled the
+// same way as emitters are, so its density is zero.
+func microfacetPdf(shape *geometry.Shape, m media, normal, outgoing, direction, scattered geometry.Vec3) float64 {
+	mf := newMicrofacet(shape)
+	reverse := direction.Mult(-1)
+	half := scattered.Add(reverse).Normalize()
+	halfO := half.Dot(reverse)
+	if outgoing.Dot(scattered) <= 0 || halfO <= 0 {
+		return 0
+	}
+	pdf := mf.d(outgoing.Dot(half)) * outgoing.Dot(half) / (4 * halfO)
+	if shape.Material == geometry.DIELECTRIC {
+		// Dielectrics only reflect the share of rays given by Fresnel
+		n1, n2, _, _ := m.refract(shape, normal, outgoing, direction)
+		pdf *= Fresnel(shape.Fresnel, halfO, n1, n2)
+	}
+	return pdf
+}
+
+// The light reflected along -direction by the microfacets of a shape from
+// the emitting shapes of the scene at time, weighed against finding them
+// with the reflected ray by multiple importance sampling.
+func reflectEmitters(shape *geometry.Shape, m media, normal, outgoing, direction, point geometry.Vec3, time float64, shapes []*geometry.Shape, tree *bvh.BVH, rand *rand.Rand) geometry.Vec3 {
+	mf := newMicrofacet(shape)
+	reverse := direction.Mult(-1)
+	n1, n2 := m.ior(), m.ior()
+	if shape.Material == geometry.DIELECTRIC {
+		n1, n2, _, _ = m.refract(shape, normal, outgoing, direction)
+	}
+
+	var light geometry.Vec3
+	sampleEmitters(point, outgoing, time, shapes, tree, rand, func(toLight, emission geometry.Vec3, pdf float64) {
+		f, half := mf.reflectance(outgoing, reverse, toLight)
+		fresnel := microfacetFresnel(shape, half.Dot(reverse), n1, n2)
+		weight := powerHeuristic(pdf, microfacetPdf(shape, m, normal, outgoing, direction, toLight))
+		light.AddInPlace(fresnel.MultVec(emission).Mult(f * weight / pdf))
+	})
+	return light
+}
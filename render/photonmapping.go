@@ -1,255 +1,357 @@
 package render
 
 import (
-	"fmt"
+	"context"
+	"github.com/BenLubar/goray/bvh"
 	"github.com/BenLubar/goray/geometry"
 	"github.com/BenLubar/goray/kd"
 	"math"
 	"math/rand"
+	"sync/atomic"
+	"time"
 )
 
+// A photon stored where it hit a surface. Sampled photons come straight
+// from an emitter whose light is also sampled directly.
 type PhotonHit struct {
 	Location, Photon, Incomming geometry.Vec3
 	Depth                       uint8
+	Sampled                     bool
 }
 
 func (p PhotonHit) Position() geometry.Vec3 {
 	return p.Location
 }
 
-type RayFunc func([]*geometry.Shape, *geometry.Shape, geometry.Ray, geometry.Vec3, chan<- PhotonHit, float64, int, *rand.Rand)
+// Traces a photon carrying color along ray and sends every photon stored
+// to result. Photons carry an equal share of the flux of their emitter,
+// relative to the 4π of a point light of unit intensity. They continue
+// past a surface with probability alpha and then carry the flux of the
+// photons that did not, so the estimates stay unbiased.
+type RayFunc func(*bvh.BVH, *geometry.Shape, geometry.Ray, geometry.Vec3, chan<- PhotonHit, float64, int, *rand.Rand)
 
-func CausticPhoton(scene []*geometry.Shape, emitter *geometry.Shape, ray geometry.Ray, color geometry.Vec3, result chan<- PhotonHit, alpha float64, depth int, rand *rand.Rand) {
+func CausticPhoton(scene *bvh.BVH, emitter *geometry.Shape, ray geometry.Ray, color geometry.Vec3, result chan<- PhotonHit, alpha float64, depth int, rand *rand.Rand) {
+	causticPhoton(scene, emitter, ray, color, result, alpha, depth, rand, nil)
+}
+
+// Photons leaving an emitter skip hits of it closer than this, which are
+// the surface they start on.
+const leaveDistance = 1e-9
+
+// The first surface hit by a photon along ray. If leave is true, the
+// photon starts on the surface of emitter and does not hit it right away.
+func photonHit(scene *bvh.BVH, emitter *geometry.Shape, ray geometry.Ray, leave bool) (*geometry.Shape, int, geometry.Vec3) {
+	shape, face, distance := scene.ClosestIntersection(ray)
+	if leave && shape != nil && shape == emitter && distance < leaveDistance {
+		ray.Origin = ray.Origin.Add(ray.Direction.Mult(leaveDistance))
+		shape, face, distance = scene.ClosestIntersection(ray)
+	}
+	return shape, face, ray.Origin.Add(ray.Direction.Mult(distance))
+}
+
+// Like CausticPhoton, for a photon inside the refractive shapes in media.
+func causticPhoton(scene *bvh.BVH, emitter *geometry.Shape, ray geometry.Ray, color geometry.Vec3, result chan<- PhotonHit, alpha float64, depth int, rand *rand.Rand, media media) {
 	if rand.Float64() > alpha {
 		return
 	}
-	if shape, distance := ClosestIntersection(scene, ray); shape != nil {
-		impact := ray.Origin.Add(ray.Direction.Mult(distance))
-		if emitter == shape {
-			// Leave the emitter first
-			nextRay := geometry.Ray{impact, ray.Direction}
-			CausticPhoton(scene, emitter, nextRay, color, result, alpha, depth, rand)
-		} else {
-			normal := shape.NormalDir(impact).Normalize()
-			reverse := ray.Direction.Mult(-1)
-			outgoing := normal
-			if normal.Dot(reverse) < 0 {
-				outgoing = normal.Mult(-1)
-			}
-			//fmt.Println("Hit something else!")
-			if depth > 0 {
-				strength := color.Mult(1.0 / (alpha + distance))
-				result <- PhotonHit{impact, strength, ray.Direction, uint8(depth)}
-			}
+	color = color.Mult(1 / alpha)
+	shape, face, impact := photonHit(scene, emitter, ray, true)
+	if shape == nil {
+		return
+	}
 
-			// Specular objects makes reflections
-			if shape.Material == geometry.SPECULAR {
-				reflection := ray.Direction.Sub(normal.Mult(2 * outgoing.Dot(ray.Direction)))
-				reflectedRay := geometry.Ray{impact, reflection.Normalize()}
-				CausticPhoton(scene, shape, reflectedRay, color, result, alpha*0.9, depth+1, rand)
-			}
+	normal := shape.PrimitiveNormal(face, impact).Normalize()
+	reverse := ray.Direction.Mult(-1)
+	outgoing := normal
+	if normal.Dot(reverse) < 0 {
+		outgoing = normal.Mult(-1)
+	}
+	if depth > 0 {
+		result <- PhotonHit{impact, color, ray.Direction, uint8(depth), false}
+	}
+
+	// Specular objects makes reflections
+	if shape.Material == geometry.SPECULAR {
+		reflection := ray.Direction.Sub(normal.Mult(2 * outgoing.Dot(ray.Direction)))
+		reflectedRay := geometry.Ray{impact, reflection.Normalize(), ray.Time}
+		causticPhoton(scene, shape, reflectedRay, color, result, alpha*0.9, depth+1, rand, media)
+	}
 
-			// Refracting objects makes refractions
-			if shape.Material == geometry.REFRACTIVE {
-				var n1, n2 float64
-				var into bool
-				if normal.Dot(outgoing) < 0 {
-					// Leave the glass
-					n1, n2 = GLASS, AIR
-					into = false
-				} else {
-					n1, n2 = AIR, GLASS
-					into = true
-				}
-
-				factor := n1 / n2
-				cosTi := normal.Dot(reverse)
-				sinTi := math.Sqrt(1 - cosTi*cosTi) // sin² + cos² = 1
-				sqrt := math.Sqrt(math.Max(1.0-math.Pow(factor*sinTi, 2), 0))
-				// Rs
-				top := n1*cosTi - n2*sqrt
-				bottom := n1*cosTi + n2*sqrt
-				Rs := math.Pow(top/bottom, 2)
-				// Rp
-				top = n1*sqrt - n2*cosTi
-				bottom = n1*sqrt + n2*cosTi
-				Rp := math.Pow(top/bottom, 2)
-
-				R := (Rs*Rs + Rp*Rp) / 2.0
-				T := 1.0 - R
-				R = math.Pow((n1-n2)/(n1+n2), 2)
-				T = 1.0 - R
-
-				if math.IsNaN(R) {
-					fmt.Printf("into: %v, sqrt: %v\n", into, sqrt)
-					fmt.Printf("cos: %v, sin: %v\n", cosTi, sinTi)
-					fmt.Printf("n1: %v, n2: %v\n", n1, n2)
-					fmt.Printf("Top: %v, Bottom: %v\n", top, bottom)
-					fmt.Printf("Rs: %v, Rp: %v\n", Rs, Rp)
-					fmt.Printf("R: %v, T: %v\n", R, T)
-					return
-				}
-
-				totalReflection := false
-				if n1 > n2 {
-					maxAngle := math.Asin(n2 / n1)
-					actualAngle := math.Asin(sinTi)
-
-					if actualAngle > maxAngle {
-						totalReflection = true
-					}
-					totalReflection = totalReflection
-				}
-
-				if totalReflection {
-					reflectionDirection := ray.Direction.Sub(normal.Mult(2 * normal.Dot(ray.Direction)))
-					reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize()}
-					CausticPhoton(scene, emitter, reflectedRay, color, result, alpha*0.9, depth+1, rand)
-				} else {
-					reflectionDirection := ray.Direction.Sub(normal.Mult(2 * normal.Dot(ray.Direction)))
-					reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize()}
-					CausticPhoton(scene, emitter, reflectedRay, color.Mult(R), result, alpha*0.9, depth+1, rand)
-
-					nDotI := normal.Dot(ray.Direction)
-					trasmittedDirection := ray.Direction.Mult(factor)
-					term2 := factor * nDotI
-					term3 := math.Sqrt(1 - factor*factor*(1-nDotI*nDotI))
-
-					trasmittedDirection = trasmittedDirection.Add(normal.Mult(term2 - term3))
-
-					transmittedRay := geometry.Ray{impact, trasmittedDirection.Normalize()}
-					CausticPhoton(scene, emitter, transmittedRay, color.Mult(T), result, alpha*0.9, depth+1, rand)
-				}
+	// Rough objects scatter around the reflection or refraction
+	if shape.Material == geometry.CONDUCTOR || shape.Material == geometry.DIELECTRIC {
+		direction, weight, inner := scatterMicrofacet(shape, media, normal, outgoing, ray.Direction, rand)
+		if !weight.IsZero() {
+			scatteredRay := geometry.Ray{impact, direction, ray.Time}
+			causticPhoton(scene, emitter, scatteredRay, color.MultVec(weight), result, alpha*0.9, depth+1, rand, inner)
+		}
+	}
+
+	// Principled objects scatter off every layer but the diffuse
+	// one like rough objects
+	if shape.Material == geometry.PRINCIPLED {
+		layer, mf := choosePrincipledLayer(shape, outgoing.Dot(reverse), rand)
+		if layer != layerDiffuse {
+			direction, weight, inner := scatterPrincipled(shape, layer, mf, media, normal, outgoing, ray.Direction, rand)
+			if !weight.IsZero() {
+				scatteredRay := geometry.Ray{impact, direction, ray.Time}
+				causticPhoton(scene, emitter, scatteredRay, color.MultVec(weight), result, alpha*0.9, depth+1, rand, inner)
 			}
 		}
 	}
+
+	// Refracting objects reflect the share R of the photons and refract
+	// the rest
+	if shape.Material == geometry.REFRACTIVE {
+		n1, n2, inner, R := media.refract(shape, normal, outgoing, ray.Direction)
+		if rand.Float64() < R {
+			reflectedRay := geometry.Ray{impact, reflectDirection(ray.Direction, outgoing), ray.Time}
+			causticPhoton(scene, emitter, reflectedRay, color, result, alpha*0.9, depth+1, rand, media)
+		} else {
+			transmittedRay := geometry.Ray{impact, refractDirection(ray.Direction, outgoing, n1, n2), ray.Time}
+			causticPhoton(scene, emitter, transmittedRay, color, result, alpha*0.9, depth+1, rand, inner)
+		}
+	}
 }
 
-func DiffusePhoton(scene []*geometry.Shape, emitter *geometry.Shape, ray geometry.Ray, color geometry.Vec3, result chan<- PhotonHit, alpha float64, depth int, rand *rand.Rand) {
+func DiffusePhoton(scene *bvh.BVH, emitter *geometry.Shape, ray geometry.Ray, color geometry.Vec3, result chan<- PhotonHit, alpha float64, depth int, rand *rand.Rand) {
 	if rand.Float64() > alpha {
 		return
 	}
-	if shape, distance := ClosestIntersection(scene, ray); shape != nil {
-		impact := ray.Origin.Add(ray.Direction.Mult(distance))
+	color = color.Mult(1 / alpha)
+	shape, face, impact := photonHit(scene, emitter, ray, depth == 0)
+	if shape == nil {
+		return
+	}
 
-		if depth == 0 && emitter == shape {
-			// Leave the emitter first
-			nextRay := geometry.Ray{impact, ray.Direction}
-			DiffusePhoton(scene, emitter, nextRay, color, result, alpha, depth, rand)
-		} else {
-			normal := shape.NormalDir(impact).Normalize()
-			reverse := ray.Direction.Mult(-1)
-			outgoing := normal
-			if normal.Dot(reverse) < 0 {
-				outgoing = normal.Mult(-1)
-			}
-			strength := color.Mult(alpha / (1 + distance))
-			result <- PhotonHit{impact, strength, ray.Direction, uint8(depth)}
-
-			if shape.Material == geometry.DIFFUSE {
-				// Random bounce for color bleeding
-				u := normal.Cross(reverse).Normalize().Mult(rand.NormFloat64() * 0.5)
-				v := u.Cross(normal).Normalize().Mult(rand.NormFloat64() * 0.5)
-				bounce := geometry.Vec3{
-					u.X + outgoing.X + v.X,
-					u.Y + outgoing.Y + v.Y,
-					u.Z + outgoing.Z + v.Z,
-				}
-				bounceRay := geometry.Ray{impact, bounce.Normalize()}
-				bleedColor := color.MultVec(shape.Color).Mult(alpha / (1 + distance))
-				DiffusePhoton(scene, shape, bounceRay, bleedColor, result, alpha*0.66, depth+1, rand)
-			}
-			// Store Shadow Photons
-			shadowRay := geometry.Ray{impact, ray.Direction}
-			DiffusePhoton(scene, shape, shadowRay, geometry.Vec3{0, 0, 0}, result, alpha*0.66, depth+1, rand)
-		}
+	normal := shape.PrimitiveNormal(face, impact).Normalize()
+	reverse := ray.Direction.Mult(-1)
+	outgoing := normal
+	if normal.Dot(reverse) < 0 {
+		outgoing = normal.Mult(-1)
 	}
-}
+	sampled := depth == 0 && (emitter == nil || emitter.Sampleable())
+	result <- PhotonHit{impact, color, ray.Direction, uint8(depth), sampled}
 
-func PhotonChunk(scene []*geometry.Shape, traceFunc RayFunc, shape *geometry.Shape, factor, start, chunksize int, result chan<- PhotonHit, done chan<- bool, rand *rand.Rand) {
-	for i := 0; i < chunksize; i++ {
-		longitude := (start*chunksize + i) / factor
-		latitude := (start*chunksize + i) % factor
+	diffuse := shape.Material == geometry.DIFFUSE
+	if shape.Material == geometry.PRINCIPLED {
+		layer, _ := choosePrincipledLayer(shape, outgoing.Dot(reverse), rand)
+		diffuse = layer == layerDiffuse
+	}
+	if diffuse {
+		// Random bounce for color bleeding
+		bounce, _ := geometry.CosineHemisphere(outgoing, rand.Float64(), rand.Float64())
+		bounceRay := geometry.Ray{impact, bounce, ray.Time}
+		DiffusePhoton(scene, shape, bounceRay, color.MultVec(shape.Color), result, alpha*0.66, depth+1, rand)
+	}
+}
 
-		//fmt.Println("Lo La:", longitude, latitude)
+// Emits photons from random points on the surface of an emitting shape,
+// cosine weighted around the normal. Triangles and meshes emit from both
+// sides. Planes emit from both sides of the disc of the plane that covers
+// the bounded shapes of the scene, like directional lights.
+func shapeEmitter(shape *geometry.Shape, tree *bvh.BVH) EmitFunc {
+	sides := 1.0
+	if shape.TwoSided() {
+		sides = 2
+	}
 
-		sign := -2.0*float64(longitude%2.0) + 1.0
-		phi := 2.0 * math.Pi * float64(longitude) / float64(factor)
-		theta := math.Pi * float64(latitude) / float64(factor)
+	if !shape.Sampleable() {
+		normal := shape.Normal.Normalize()
+		u, v := geometry.OrthonormalBasis(normal)
+		min, max, _ := tree.Bounds()
+		center := min.Add(max).Mult(0.5)
+		center = center.Sub(normal.Mult(center.Sub(shape.Position).Dot(normal)))
+		radius := max.Sub(min).Abs() / 2
+		return func(i int, rand *rand.Rand) (geometry.Ray, geometry.Vec3) {
+			r, phi := radius*math.Sqrt(rand.Float64()), 2*math.Pi*rand.Float64()
+			origin := center.Add(u.Mult(r * math.Cos(phi))).Add(v.Mult(r * math.Sin(phi)))
+			return emitFrom(shape, origin, normal, 1/(math.Pi*radius*radius), sides, rand)
+		}
+	}
 
-		//fmt.Println("S, T, P:", sign, theta, phi)
+	return func(i int, rand *rand.Rand) (geometry.Ray, geometry.Vec3) {
+		origin, normal, _, pdf := shape.SampleArea(rand.Float64(), rand.Float64())
+		if pdf == 0 {
+			return geometry.Ray{origin, normal, 0}, geometry.Vec3{}
+		}
+		return emitFrom(shape, origin, normal, pdf, sides, rand)
+	}
+}
 
-		x, y, z := math.Sin(theta)*math.Cos(phi),
-			sign*math.Cos(theta),
-			math.Sin(theta)*math.Sin(phi)
+// A photon leaving origin on the surface of shape picked with density pdf
+// per unit area. A diffuse emitter of radiance L sends out π·L·area on
+// every side, which is sides·L/(4·pdf) relative to a point light.
+func emitFrom(shape *geometry.Shape, origin, normal geometry.Vec3, pdf, sides float64, rand *rand.Rand) (geometry.Ray, geometry.Vec3) {
+	if sides == 2 && rand.Float64() < 0.5 {
+		normal = normal.Mult(-1)
+	}
+	direction, _ := geometry.CosineHemisphere(normal, rand.Float64(), rand.Float64())
+	return geometry.Ray{origin, direction, 0}, shape.Emission.Mult(sides / (4 * pdf))
+}
 
-		direction := geometry.Vec3{x, y, z}
-		ray := geometry.Ray{shape.Position, direction.Normalize()}
-		traceFunc(scene, shape, ray, shape.Emission, result, 1.0, 0, rand)
+// Traces the photons start*chunksize up to (start+1)*chunksize of an
+// emitter. emitter is nil for lights.
+func PhotonChunk(ctx context.Context, scene *bvh.BVH, traceFunc RayFunc, emitter *geometry.Shape, emit EmitFunc, start, chunksize int, result chan<- PhotonHit, done chan<- bool, traced *int64, rand *rand.Rand) {
+	for i := 0; i < chunksize && ctx.Err() == nil; i++ {
+		ray, color := emit(start*chunksize+i, rand)
+		traceFunc(scene, emitter, ray, color, result, 1.0, 0, rand)
+		atomic.AddInt64(traced, 1)
 	}
 	done <- true
 }
 
-func PhotonMapping(scene []*geometry.Shape, factor int, rayFunc RayFunc) ([]geometry.Vec3, []PhotonHit) {
+// The photons are traced in this many chunks in parallel
+const photonChunks = 8
+
+// The number of photons PhotonMapping traces from every emitter.
+func photonCount(factor int) int {
+	return photonChunks * (factor * factor * 2 / photonChunks)
+}
+
+// Traces about factor*factor*2 photons, photonCount(factor) exactly, from
+// every emitting shape and light of the scene, as it is when the shutter
+// opens.
+func (r *Renderer) PhotonMapping(ctx context.Context, scene *geometry.Scene, factor int, rayFunc RayFunc) ([]PhotonHit, error) {
 	var (
-		points []geometry.Vec3
 		result []PhotonHit
+		traced int64
 	)
-	photons := factor * factor * 2
-	chunks := 8
-	chunksize := photons / chunks
+	chunks := photonChunks
+	chunksize := photonCount(factor) / chunks
+
+	type source struct {
+		emitter *geometry.Shape
+		emit    EmitFunc
+	}
+	var sources []source
+	for _, shape := range scene.Objects {
+		if !shape.Emission.IsZero() {
+			sources = append(sources, source{shape, shapeEmitter(shape, r.tree)})
+		}
+	}
+	for _, light := range scene.Lights {
+		sources = append(sources, source{nil, lightEmitter(light, r.tree)})
+	}
+	total := len(sources) * chunks * chunksize
+	startTime := time.Now()
+	r.report(PhotonTracing, 0, total, startTime)
 
-	for _, shape := range scene {
+	for _, s := range sources {
 		hits := make(chan PhotonHit)
 		done := make(chan bool)
-		if !shape.Emission.IsZero() {
+		for start := 0; start < chunks; start++ {
+			go PhotonChunk(ctx, r.tree, rayFunc, s.emitter, s.emit, start, chunksize, hits, done, &traced, rand.New(rand.NewSource(r.rand.Int63())))
+		}
+
+		go func() {
 			for start := 0; start < chunks; start++ {
-				go PhotonChunk(scene, rayFunc, shape, factor, start, chunksize, hits, done, rand.New(rand.NewSource(rand.Int63())))
+				<-done
 			}
-
-			go func() {
-				for start := 0; start < chunks; start++ {
-					<-done
-				}
-				close(hits)
-			}()
-
-			count := 0
-			const tick = 10000
-			fmt.Printf("Tracing %v photons through the scene ", photons)
-			for photon := range hits {
-				points = append(points, photon.Position())
-				result = append(result, photon)
-				count++
-				if count%tick == 0 {
-					fmt.Printf(".")
-					if count%(10*tick) == 0 {
-						clearLine()
-						fmt.Printf("Tracing %v photons through the scene ", photons)
-					}
-				}
+			close(hits)
+		}()
+
+		// Keep receiving after a cancellation until every chunk has
+		// noticed it and stopped.
+		count := 0
+		const tick = 10000
+		for photon := range hits {
+			result = append(result, photon)
+			count++
+			if count%tick == 0 {
+				r.report(PhotonTracing, int(atomic.LoadInt64(&traced)), total, startTime)
 			}
-			fmt.Printf("\rTraced %v photons to %v intersections in the scene.          \n", photons, count)
 		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	r.report(PhotonTracing, total, total, startTime)
+	return result, nil
+}
+
+// Traces photons from every emitter and stores them in the diffuse and
+// caustics photon maps of the renderer.
+func (r *Renderer) GenerateMaps(ctx context.Context, scene *geometry.Scene) error {
+	var caustics []PhotonHit
+	var err error
+	if r.Caustics >= 0 {
+		caustics, err = r.PhotonMapping(ctx, scene, r.Caustics, CausticPhoton)
+		if err != nil {
+			return err
+		}
+	}
+	factor := r.DiffusePhotons
+	if factor <= 0 {
+		factor = 16
+	}
+	globals, err := r.PhotonMapping(ctx, scene, factor, DiffusePhoton)
+	if err != nil {
+		return err
 	}
-	return points, result
+
+	startTime := time.Now()
+	r.report(BuildingMaps, 0, 1, startTime)
+
+	// Every emitter shares its flux over the photons it traces.
+	r.diffuseFlux = 4 * math.Pi / float64(photonCount(factor))
+	if n := photonCount(r.Caustics); r.Caustics > 0 && n > 0 {
+		r.causticFlux = 4 * math.Pi / float64(n)
+	}
+
+	r.diffuseMap, r.causticsMap = kd.New(globals), kd.New(caustics)
+	r.report(BuildingMaps, 1, 1, startTime)
+	return nil
 }
 
-var causticPhotons map[geometry.Vec3]PhotonHit
+// The photon map searches of one worker, which reuse their storage.
+type photonSearch struct {
+	diffuse, caustics *kd.Searcher[PhotonHit]
+}
+
+func (r *Renderer) newPhotonSearch() *photonSearch {
+	return &photonSearch{r.diffuseMap.Searcher(), r.causticsMap.Searcher()}
+}
 
-func GenerateMaps(scene []*geometry.Shape) (*kd.KDNode, *kd.KDNode) {
-	var caustics []geometry.Vec3
-	var caustics_ []PhotonHit
-	if Config.Caustics >= 0 {
-		caustics, caustics_ = PhotonMapping(scene, Config.Caustics, CausticPhoton)
+// The photons of a map used to estimate the light at point, and the radius
+// they were found in. They are only valid until the next search.
+func (r *Renderer) nearestPhotons(photons *kd.Searcher[PhotonHit], point geometry.Vec3, radius float64) ([]PhotonHit, float64) {
+	if r.EstimatePhotons > 0 {
+		return photons.KNearest(point, r.EstimatePhotons, radius)
 	}
-	globals, _ := PhotonMapping(scene, 16, DiffusePhoton)
-	fmt.Printf("Building KD-trees ...")
+	return photons.Neighbors(point, radius), radius
+}
 
-	causticPhotons = make(map[geometry.Vec3]PhotonHit, len(caustics))
-	for i := range caustics {
-		causticPhotons[caustics[i]] = caustics_[i]
+// Estimates the indirect light arriving at point from the diffuse photons
+// within PhotonRadius, or the EstimatePhotons nearest of them. Photons
+// coming straight from an emitter are left out if its light is sampled
+// separately, which planes are not.
+func (r *Renderer) DiffuseEstimate(point, normal geometry.Vec3, search *photonSearch) geometry.Vec3 {
+	return r.estimate(search.diffuse, point, normal, r.PhotonRadius, r.diffuseFlux, false)
+}
+
+// Estimates the caustic light arriving at point like DiffuseEstimate, from
+// the caustic photons within CausticRadius.
+func (r *Renderer) CausticEstimate(point, normal geometry.Vec3, search *photonSearch) geometry.Vec3 {
+	radius := r.CausticRadius
+	if radius <= 0 {
+		radius = 0.1
 	}
+	return r.estimate(search.caustics, point, normal, radius, r.causticFlux, false)
+}
 
-	return kd.New(globals), kd.New(caustics)
+// The light reflected by a white diffuse surface facing normal at point,
+// from the photons that reached it, counting sampled photons only if
+// sampled is true. Their flux, each photon carrying flux, is divided by the
+// area of the disc they were found in.
+func (r *Renderer) estimate(photons *kd.Searcher[PhotonHit], point, normal geometry.Vec3, radius, flux float64, sampled bool) geometry.Vec3 {
+	var power geometry.Vec3
+	found, radius := r.nearestPhotons(photons, point, radius)
+	for _, photon := range found {
+		// Only photons arriving on the side of the surface count
+		if (sampled || !photon.Sampled) && normal.Dot(photon.Incomming) < 0 {
+			power.AddInPlace(photon.Photon)
+		}
+	}
+	area := math.Pi * radius * radius
+	return power.Mult(flux / (area * math.Pi))
 }
@@ -0,0 +1,54 @@
+package render
+
+import (
+	"context"
+	"github.com/BenLubar/goray/bvh"
+	"github.com/BenLubar/goray/geometry"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+const pointLightScene = `{
+	"Objects": [{
+		"Type":     "PLANE",
+		"Material": "DIFFUSE",
+		"Position": [0, 0, 0],
+		"Color":    [0.5, 0.5, 0.5],
+		"Normal":   [0, 1, 0]
+	}],
+	"Lights": [{
+		"Type":     "POINT",
+		"Position": [0, 1, 0],
+		"Color":    [1, 1, 1]
+	}],
+	"Camera": [0, 0, -10]
+}`
+
+// The photons straight from a point light give a plane under it the same
+// light as sampling the light directly.
+func TestPhotonsMatchDirectLight(t *testing.T) {
+	scene, err := geometry.ReadScene(strings.NewReader(pointLightScene), ".", 2, 2, 1, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(Options{Caustics: -1, DiffusePhotons: 400, Seed: 1})
+	r.tree = bvh.New(scene.Objects, 0)
+	if err := r.GenerateMaps(context.Background(), &scene); err != nil {
+		t.Fatal(err)
+	}
+
+	point, normal := geometry.Vec3{0, 0, 0}, geometry.Vec3{0, 1, 0}
+	const radius = 0.1
+	photons := r.estimate(r.diffuseMap.Searcher(), point, normal, radius, r.diffuseFlux, true)
+	direct := LightSampling(point, normal, 0, scene.Lights, r.tree, rand.New(rand.NewSource(1)))
+
+	// The irradiance falls off towards the edge of the disc the photons
+	// are gathered from, to its average over the disc.
+	h := 1.0
+	direct = direct.Mult(2 * h * h / (radius * radius) * (1 - h/math.Sqrt(h*h+radius*radius)))
+	if math.Abs(photons.X/direct.X-1) > 0.1 {
+		t.Errorf("photons give %v, direct light %v", photons.X, direct.X)
+	}
+}
@@ -0,0 +1,111 @@
+package render
+
+import (
+	"github.com/BenLubar/goray/bvh"
+	"github.com/BenLubar/goray/geometry"
+	"math"
+	"math/rand"
+)
+
+// The layers of a principled shape that can scatter light.
+type principledLayer int
+
+const (
+	layerDiffuse principledLayer = iota
+	// The clearcoat or the reflection off the dielectric base, which are
+	// white.
+	layerSpecular
+	// The reflection off the metal base, tinted by the base color.
+	layerMetal
+	// Light going through the dielectric base, tinted by the base color.
+	layerTransmission
+)
+
+// Chooses the layer of a principled shape scattering a ray that hits it at
+// an angle with cosine cosO, each with the probability of light reaching
+// it and being scattered by it, so that the shares of the layers cancel
+// out of their weights. Also returns the microfacets of the layer.
+func choosePrincipledLayer(shape *geometry.Shape, cosO float64, rand *rand.Rand) (principledLayer, microfacet) {
+	// Schlick's approximation, with 4% reflected head on like glass
+	fresnel := math.Pow(1-math.Max(cosO, 0), 5)
+	if rand.Float64() < shape.Clearcoat*(0.04+0.96*fresnel) {
+		roughness := shape.ClearcoatRoughness
+		return layerSpecular, microfacet{geometry.GGX, math.Max(roughness*roughness, 1e-3)}
+	}
+
+	mf := newMicrofacet(shape)
+	if rand.Float64() < shape.Metallic {
+		return layerMetal, mf
+	}
+	f0 := 0.08 * shape.Specular
+	if rand.Float64() < f0+(1-f0)*fresnel {
+		return layerSpecular, mf
+	}
+	if rand.Float64() < shape.Transmission {
+		return layerTransmission, mf
+	}
+	return layerDiffuse, mf
+}
+
+// Schlick's approximation of the share of light reflected by a metal with
+// the base color of shape, hit at an angle with cosine cos.
+func metalFresnel(shape *geometry.Shape, cos float64) geometry.Vec3 {
+	fresnel := math.Pow(1-math.Max(cos, 0), 5)
+	white := geometry.Vec3{1, 1, 1}
+	return shape.Color.Add(white.Sub(shape.Color).Mult(fresnel))
+}
+
+// Like scatterMicrofacet, for the chosen layer of a principled shape.
+func scatterPrincipled(shape *geometry.Shape, layer principledLayer, mf microfacet, m media, normal, outgoing, direction geometry.Vec3, rand *rand.Rand) (geometry.Vec3, geometry.Vec3, media) {
+	if layer == layerDiffuse {
+		bounce, _ := geometry.CosineHemisphere(outgoing, rand.Float64(), rand.Float64())
+		return bounce, shape.Color, m
+	}
+
+	half := mf.sample(outgoing, rand)
+	reverse := direction.Mult(-1)
+	cosO, cosH, halfO := outgoing.Dot(reverse), outgoing.Dot(half), half.Dot(reverse)
+	if cosO <= 0 || halfO <= 0 {
+		return geometry.Vec3{}, geometry.Vec3{}, m
+	}
+
+	switch layer {
+	case layerMetal:
+		reflected, weight := mf.reflect(outgoing, half, direction)
+		return reflected, metalFresnel(shape, halfO).Mult(weight), m
+	case layerTransmission:
+		n1, n2, inner, _ := m.refract(shape, normal, outgoing, direction)
+		if Fresnel(shape.Fresnel, halfO, n1, n2) < 1 {
+			transmitted := refractDirection(direction, half, n1, n2)
+			cosT := outgoing.Dot(transmitted)
+			if cosT >= 0 {
+				return geometry.Vec3{}, geometry.Vec3{}, m
+			}
+			weight := mf.g1(cosO) * mf.g1(cosT) * halfO / (cosO * cosH)
+			return transmitted, shape.Color.Mult(weight), inner
+		}
+		// Total internal reflection
+	}
+	reflected, weight := mf.reflect(outgoing, half, direction)
+	return reflected, geometry.Vec3{weight, weight, weight}, m
+}
+
+// Like reflectLights, for the chosen layer of a principled shape. The
+// diffuse layer is lit by the usual diffuse light sampling and transmitted
+// light is left out.
+func principledLights(shape *geometry.Shape, layer principledLayer, mf microfacet, outgoing, direction, point geometry.Vec3, time float64, lights []*geometry.Light, tree *bvh.BVH, rand *rand.Rand) geometry.Vec3 {
+	if layer != layerSpecular && layer != layerMetal {
+		return geometry.Vec3{}
+	}
+	reverse := direction.Mult(-1)
+
+	var light geometry.Vec3
+	sampleLights(point, outgoing, time, lights, tree, rand, func(toLight, irradiance geometry.Vec3) {
+		f, half := mf.reflectance(outgoing, reverse, toLight)
+		if layer == layerMetal {
+			irradiance = metalFresnel(shape, half.Dot(reverse)).MultVec(irradiance)
+		}
+		light.AddInPlace(irradiance.Mult(f))
+	})
+	return light
+}
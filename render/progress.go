@@ -0,0 +1,48 @@
+package render
+
+import (
+	"time"
+)
+
+type Phase int
+
+const (
+	PhotonTracing Phase = iota
+	BuildingMaps
+	Rendering
+	PostProcessing
+)
+
+var phaseNames = map[Phase]string{
+	PhotonTracing:  "Tracing photons",
+	BuildingMaps:   "Building KD-trees",
+	Rendering:      "Rendering",
+	PostProcessing: "Post processing",
+}
+
+func (p Phase) String() string {
+	return phaseNames[p]
+}
+
+// Progress is reported to Options.Progress while rendering. Done and
+// Total count photons while tracing photons, pixels while rendering and
+// bloom filter iterations while post processing. Every phase reports
+// Done == Total when it finishes.
+type Progress struct {
+	Phase       Phase
+	Done, Total int
+	Elapsed     time.Duration
+	Remaining   time.Duration
+}
+
+func (r *Renderer) report(phase Phase, done, total int, start time.Time) {
+	if r.Progress == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	var remaining time.Duration
+	if done > 0 {
+		remaining = elapsed * time.Duration(total-done) / time.Duration(done)
+	}
+	r.Progress(Progress{phase, done, total, elapsed, remaining})
+}
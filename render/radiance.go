@@ -1,84 +1,148 @@
 package render
 
 import (
-	"fmt"
+	"github.com/BenLubar/goray/bvh"
 	"github.com/BenLubar/goray/geometry"
-	"github.com/BenLubar/goray/kd"
 	"math"
 	"math/rand"
 )
 
-func EmitterSampling(point, normal geometry.Vec3, shapes []*geometry.Shape, rand *rand.Rand) geometry.Vec3 {
+// Samples a point on every emitting shape that can be sampled, where it is
+// at time, and sums the light arriving at point from them, as reflected by
+// a white diffuse surface facing normal. If bounced the emitters may also be hit by the
+// diffuse bounce, so both are weighed by multiple importance sampling.
+func EmitterSampling(point, normal geometry.Vec3, time float64, shapes []*geometry.Shape, tree *bvh.BVH, bounced bool, rand *rand.Rand) geometry.Vec3 {
 	incomingLight := geometry.Vec3{0, 0, 0}
+	sampleEmitters(point, normal, time, shapes, tree, rand, func(direction, emission geometry.Vec3, lightPdf float64) {
+		weight := 1.0
+		if bounced {
+			weight = powerHeuristic(lightPdf, geometry.CosineHemispherePdf(normal, direction))
+		}
+		incomingLight.AddInPlace(emission.Mult(weight * direction.Dot(normal) / (math.Pi * lightPdf)))
+	})
+	return incomingLight
+}
 
+// Calls f with the direction towards a random point on every emitting
+// shape that can be sampled, on the side of normal and not in the shadow of
+// another shape at time, its emission and the density per unit solid angle
+// of sampling that direction.
+func sampleEmitters(point, normal geometry.Vec3, time float64, shapes []*geometry.Shape, tree *bvh.BVH, rand *rand.Rand, f func(direction, emission geometry.Vec3, pdf float64)) {
 	for _, shape := range shapes {
-		if !shape.Emission.IsZero() {
-			// It's a light source
-			direction := shape.NormalDir(point).Mult(-1)
-			u := direction.Cross(normal).Normalize().Mult(rand.NormFloat64() * 0.3)
-			v := direction.Cross(u).Normalize().Mult(rand.NormFloat64() * 0.3)
-
-			direction.X += u.X + v.X
-			direction.Y += u.Y + v.Y
-			direction.Z += u.Z + v.Z
-			ray := geometry.Ray{point, direction.Normalize()}
-
-			if object, distance := ClosestIntersection(shapes, ray); object == shape {
-				incomingLight.AddInPlace(object.Emission.Mult(direction.Dot(normal) / (1 + distance)))
-			}
+		if shape.Emission.IsZero() || !shape.Sampleable() {
+			continue
+		}
+		offset := shape.Offset(time)
+		position, lightPdf := shape.SampleSurface(point.Sub(offset), rand.Float64(), rand.Float64())
+		if lightPdf == 0 {
+			continue
+		}
+		position = position.Add(offset)
+		toLight := position.Sub(point)
+		distance := toLight.Abs()
+		direction := toLight.Mult(1 / distance)
+		if direction.Dot(normal) <= 0 {
+			continue
+		}
+
+		// The sampled point must be the first thing hit
+		object, _, hit := tree.ClosestIntersection(geometry.Ray{point, direction, time})
+		if object != shape || hit < distance*(1-1e-6) {
+			continue
 		}
+
+		f(direction, shape.Emission, lightPdf)
 	}
-	return incomingLight
 }
 
-func Radiance(ray geometry.Ray, scene *geometry.Scene, diffuseMap, causticsMap *kd.KDNode, depth int, alpha float64, rand *rand.Rand) geometry.Vec3 {
+// The multiple importance sampling weight of a sample taken with density
+// pdf when another strategy could have taken it with density other.
+func powerHeuristic(pdf, other float64) float64 {
+	return pdf * pdf / (pdf*pdf + other*other)
+}
+
+// How a path reached the surface hit by a ray, and the refractive shapes
+// it is inside of. pdf is the density of the bounce from origin in the
+// direction of the ray, for weighing the emission of the surface against
+// emitter sampling at origin, or zero if emitters were not sampled there. search is used for the photon estimates along the path.
+type pathState struct {
+	gathered bool
+	media    media
+	origin   geometry.Vec3
+	pdf      float64
+	search   *photonSearch
+}
+
+// The state of a path continuing by specular reflection or refraction.
+func (p pathState) specular() pathState {
+	return pathState{p.gathered, p.media, geometry.Vec3{}, 0, p.search}
+}
 
-	if depth > Config.MinDepth && rand.Float64() > alpha {
+func (r *Renderer) Radiance(ray geometry.Ray, scene *geometry.Scene, depth int, alpha float64, rand *rand.Rand) geometry.Vec3 {
+	return r.radiance(ray, scene, depth, alpha, rand, nil, pathState{search: r.newPhotonSearch()})
+}
+
+// Like Radiance, but also describes the surface hit by the ray in hit if
+// it is not nil. path.gathered is set once the path has done final
+// gathering.
+func (r *Renderer) radiance(ray geometry.Ray, scene *geometry.Scene, depth int, alpha float64, rand *rand.Rand, hit *surfaceHit, path pathState) geometry.Vec3 {
+	if depth > r.MinDepth && rand.Float64() > alpha {
 		return geometry.Vec3{0, 0, 0}
 	}
 
-	if shape, distance := ClosestIntersection(scene.Objects, ray); shape != nil {
+	if shape, face, distance := r.tree.ClosestIntersection(ray); shape != nil {
 		impact := ray.Origin.Add(ray.Direction.Mult(distance))
-		normal := shape.NormalDir(impact).Normalize()
+		// Moving shapes are where they were at the time of the ray
+		offset := shape.Offset(ray.Time)
+		normal := shape.PrimitiveNormal(face, impact.Sub(offset)).Normalize()
 		reverse := ray.Direction.Mult(-1)
 
 		contribution := shape.Emission
+		if path.pdf > 0 && !contribution.IsZero() && shape.Sampleable() {
+			lightPdf := shape.SurfacePdf(path.origin.Sub(offset), impact.Sub(offset), face)
+			contribution = contribution.Mult(powerHeuristic(path.pdf, lightPdf))
+		}
 		outgoing := normal
 		if normal.Dot(reverse) < 0 {
 			outgoing = normal.Mult(-1)
 		}
+		if hit != nil {
+			hit.shape, hit.distance, hit.normal = shape, distance, outgoing
+		}
 
 		if shape.Material == geometry.DIFFUSE {
-			var causticLight, directLight geometry.Vec3
-
-			nodes := causticsMap.Neighbors(impact, 0.1)
-			for _, e := range nodes {
-				photon := causticPhotons[e.Position]
-				dist := photon.Location.Distance(impact)
-				light := photon.Photon.Mult(outgoing.Dot(photon.Incomming.Mult(-1 / math.Pi * (1 + dist))))
-				causticLight.AddInPlace(light)
-			}
-			if len(nodes) > 0 {
-				causticLight = causticLight.Mult(1.0 / float64(len(nodes)))
-			}
-
-			directLight = EmitterSampling(impact, normal, scene.Objects, rand)
-
-			u := normal.Cross(reverse).Normalize().Mult(rand.NormFloat64() * 0.5)
-			v := u.Cross(normal).Normalize().Mult(rand.NormFloat64() * 0.5)
-
-			bounceDirection := geometry.Vec3{
-				u.X + outgoing.X + v.X,
-				u.Y + outgoing.Y + v.Y,
-				u.Z + outgoing.Z + v.Z,
+			var directLight geometry.Vec3
+			causticLight := r.CausticEstimate(impact, outgoing, path.search)
+
+			// Emitters are also found by the diffuse bounce unless the
+			// photon map replaces it.
+			bounced := r.PhotonRadius <= 0 || (r.FinalGather > 0 && !path.gathered)
+			directLight = EmitterSampling(impact, outgoing, ray.Time, scene.Objects, r.tree, bounced, rand)
+			directLight.AddInPlace(LightSampling(impact, outgoing, ray.Time, scene.Lights, r.tree, rand))
+
+			var indirectLight geometry.Vec3
+			switch {
+			case r.PhotonRadius <= 0:
+				direction, pdf := geometry.CosineHemisphere(outgoing, rand.Float64(), rand.Float64())
+				bounceRay := geometry.Ray{impact, direction, ray.Time}
+				indirectLight = r.radiance(bounceRay, scene, depth+1, alpha*0.9, rand, nil, pathState{path.gathered, path.media, impact, pdf, path.search})
+			case bounced:
+				// The gather rays see the photon estimate at the
+				// surfaces they hit.
+				for i := 0; i < r.FinalGather; i++ {
+					direction, pdf := geometry.CosineHemisphere(outgoing, rand.Float64(), rand.Float64())
+					gatherRay := geometry.Ray{impact, direction, ray.Time}
+					indirectLight.AddInPlace(r.radiance(gatherRay, scene, depth+1, alpha*0.9, rand, nil, pathState{true, path.media, impact, pdf, path.search}))
+				}
+				indirectLight = indirectLight.Mult(1.0 / float64(r.FinalGather))
+			default:
+				indirectLight = r.DiffuseEstimate(impact, outgoing, path.search)
 			}
-			bounceRay := geometry.Ray{impact, bounceDirection.Normalize()}
-			indirectLight := Radiance(bounceRay, scene, diffuseMap, causticsMap, depth+1, alpha*0.9, rand)
-			dot := outgoing.Dot(reverse)
-			diffuseLight := geometry.Vec3{
-				(shape.Color.X*(directLight.X+indirectLight.X) + causticLight.X) * dot,
-				(shape.Color.Y*(directLight.Y+indirectLight.Y) + causticLight.Y) * dot,
-				(shape.Color.Z*(directLight.Z+indirectLight.Z) + causticLight.Z) * dot,
+			// A diffuse surface looks the same from every direction
+			diffuseLight := shape.Color.MultVec(directLight.Add(indirectLight).Add(causticLight))
+			if hit != nil {
+				hit.direct = contribution.Add(shape.Color.MultVec(directLight))
+				hit.caustic = shape.Color.MultVec(causticLight)
 			}
 
 			return contribution.Add(diffuseLight)
@@ -86,81 +150,60 @@ func Radiance(ray geometry.Ray, scene *geometry.Scene, diffuseMap, causticsMap *
 		}
 		if shape.Material == geometry.SPECULAR {
 			reflectionDirection := ray.Direction.Sub(normal.Mult(2 * outgoing.Dot(ray.Direction)))
-			reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize()}
-			incomingLight := Radiance(reflectedRay, scene, diffuseMap, causticsMap, depth+1, alpha*0.99, rand)
+			reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize(), ray.Time}
+			incomingLight := r.radiance(reflectedRay, scene, depth+1, alpha*0.99, rand, nil, path.specular())
 			return incomingLight.Mult(outgoing.Dot(reverse))
 		}
 
 		if shape.Material == geometry.REFRACTIVE {
-			var n1, n2 float64
-			if normal.Dot(outgoing) < 0 {
-				// Leave the glass
-				n1, n2 = GLASS, AIR
-			} else {
-				n1, n2 = AIR, GLASS
-			}
+			n1, n2, inner, R := path.media.refract(shape, normal, outgoing, ray.Direction)
 
-			factor := n1 / n2
-			cosTi := normal.Dot(reverse)
-			sinTi := math.Sqrt(1 - cosTi*cosTi) // sin² + cos² = 1
-			sqrt := math.Sqrt(math.Max(1.0-math.Pow(factor*sinTi, 2), 0))
-			// Rs
-			top := n1*cosTi - n2*sqrt
-			bottom := n1*cosTi + n2*sqrt
-			Rs := math.Pow(top/bottom, 2)
-			// Rp
-			top = n1*sqrt - n2*cosTi
-			bottom = n1*sqrt + n2*cosTi
-			Rp := math.Pow(top/bottom, 2)
-
-			R := (Rs*Rs + Rp*Rp) / 2.0
-
-			// Approximate:
-			R = math.Pow((n1-n2)/(n1+n2), 2)
-			// SmallPT formula
-			//R = R + (1 - R) * math.Pow(1 - cosTi, 5)
-			T := 1.0 - R
-
-			if math.IsNaN(R) {
-				fmt.Printf("into: %v, sqrt: %v\n", n2 > n1, sqrt)
-				fmt.Printf("cos: %v, sin: %v\n", cosTi, sinTi)
-				fmt.Printf("n1: %v, n2: %v\n", n1, n2)
-				fmt.Printf("Top: %v, Bottom: %v\n", top, bottom)
-				fmt.Printf("Rs: %v, Rp: %v\n", Rs, Rp)
-				fmt.Printf("R: %v, T: %v\n", R, T)
-				panic("NAN!")
+			reflectedRay := geometry.Ray{impact, reflectDirection(ray.Direction, outgoing), ray.Time}
+			if R >= 1 {
+				// Total internal reflection
+				return r.radiance(reflectedRay, scene, depth+1, alpha*0.9, rand, nil, path.specular())
 			}
+			reflectedLight := r.radiance(reflectedRay, scene, depth+1, alpha*0.9, rand, nil, path.specular()).Mult(R)
 
-			totalReflection := false
-			if n1 > n2 {
-				maxAngle := math.Asin(n2 / n1)
-				actualAngle := math.Asin(sinTi)
-
-				if actualAngle > maxAngle {
-					totalReflection = true
+			transmitted := path.specular()
+			transmitted.media = inner
+			transmittedRay := geometry.Ray{impact, refractDirection(ray.Direction, outgoing, n1, n2), ray.Time}
+			transmittedLight := r.radiance(transmittedRay, scene, depth+1, alpha*0.9, rand, nil, transmitted).Mult(1 - R)
+			return reflectedLight.Add(transmittedLight).Mult(outgoing.Dot(reverse))
+		}
+		if shape.Material == geometry.CONDUCTOR || shape.Material == geometry.DIELECTRIC {
+			light := reflectLights(shape, path.media, normal, outgoing, ray.Direction, impact, ray.Time, scene.Lights, r.tree, rand)
+			light.AddInPlace(reflectEmitters(shape, path.media, normal, outgoing, ray.Direction, impact, ray.Time, scene.Objects, r.tree, rand))
+			direction, weight, inner := scatterMicrofacet(shape, path.media, normal, outgoing, ray.Direction, rand)
+			if !weight.IsZero() {
+				next := path.specular()
+				next.media = inner
+				next.origin, next.pdf = impact, microfacetPdf(shape, path.media, normal, outgoing, ray.Direction, direction)
+				incomingLight := r.radiance(geometry.Ray{impact, direction, ray.Time}, scene, depth+1, alpha*0.9, rand, nil, next)
+				light.AddInPlace(weight.MultVec(incomingLight))
+			}
+			return contribution.Add(light)
+		}
+		if shape.Material == geometry.PRINCIPLED {
+			layer, mf := choosePrincipledLayer(shape, outgoing.Dot(reverse), rand)
+			light := principledLights(shape, layer, mf, outgoing, ray.Direction, impact, ray.Time, scene.Lights, r.tree, rand)
+			direction, weight, inner := scatterPrincipled(shape, layer, mf, path.media, normal, outgoing, ray.Direction, rand)
+			next := path.specular()
+			next.media = inner
+			if layer == layerDiffuse {
+				directLight := EmitterSampling(impact, outgoing, ray.Time, scene.Objects, r.tree, true, rand)
+				directLight.AddInPlace(LightSampling(impact, outgoing, ray.Time, scene.Lights, r.tree, rand))
+				light = shape.Color.MultVec(directLight)
+				next.origin, next.pdf = impact, geometry.CosineHemispherePdf(outgoing, direction)
+				if hit != nil {
+					hit.direct = contribution.Add(light)
 				}
-				totalReflection = totalReflection
 			}
-
-			if totalReflection {
-				reflectionDirection := ray.Direction.Sub(outgoing.Mult(2 * outgoing.Dot(ray.Direction)))
-				reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize()}
-				return Radiance(reflectedRay, scene, diffuseMap, causticsMap, depth+1, alpha*0.9, rand)
-			} else {
-				reflectionDirection := ray.Direction.Sub(outgoing.Mult(2 * outgoing.Dot(ray.Direction)))
-				reflectedRay := geometry.Ray{impact, reflectionDirection.Normalize()}
-				reflectedLight := Radiance(reflectedRay, scene, diffuseMap, causticsMap, depth+1, alpha*0.9, rand).Mult(R)
-
-				nDotI := normal.Dot(ray.Direction)
-				trasmittedDirection := ray.Direction.Mult(factor)
-				term2 := factor * nDotI
-				term3 := math.Sqrt(1 - factor*factor*(1-nDotI*nDotI))
-
-				trasmittedDirection = trasmittedDirection.Add(normal.Mult(term2 - term3))
-				transmittedRay := geometry.Ray{impact, trasmittedDirection.Normalize()}
-				transmittedLight := Radiance(transmittedRay, scene, diffuseMap, causticsMap, depth+1, alpha*0.9, rand).Mult(T)
-				return reflectedLight.Add(transmittedLight).Mult(outgoing.Dot(reverse))
+			if !weight.IsZero() {
+				incomingLight := r.radiance(geometry.Ray{impact, direction, ray.Time}, scene, depth+1, alpha*0.9, rand, nil, next)
+				light.AddInPlace(weight.MultVec(incomingLight))
 			}
+			return contribution.Add(light)
 		}
 		panic("Material without property encountered!")
 	}
@@ -0,0 +1,198 @@
+package render
+
+import (
+	"image"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// The order in which tiles of the image are handed to the workers.
+type TileOrder int
+
+const (
+	// Starting at the center of the image and spiralling outwards
+	Spiral TileOrder = iota
+	// Along a Hilbert curve, keeping consecutive tiles close together
+	Hilbert
+	// Row by row from the top left
+	Scanline
+)
+
+var tileOrders = map[string]TileOrder{
+	"spiral":   Spiral,
+	"hilbert":  Hilbert,
+	"scanline": Scanline,
+}
+
+// Looks up a tile order by its lower case name.
+func ParseTileOrder(name string) (TileOrder, bool) {
+	order, ok := tileOrders[name]
+	return order, ok
+}
+
+// Every tile gets its own random seed so that the rendered image does not
+// depend on which worker happens to render it. index is its place in the
+// tile order.
+type tile struct {
+	bounds image.Rectangle
+	seed   int64
+	index  int
+}
+
+// Splits the rows and columns of the image into tiles of at most size by
+// size pixels, ordered as requested.
+func makeTiles(cols, rows, size int, order TileOrder) []image.Rectangle {
+	if size < 1 {
+		size = 1
+	}
+	tilesX, tilesY := (cols+size-1)/size, (rows+size-1)/size
+
+	var cells []image.Point
+	switch order {
+	case Spiral:
+		cells = spiralOrder(tilesX, tilesY)
+	case Hilbert:
+		cells = hilbertOrder(tilesX, tilesY)
+	default:
+		for y := 0; y < tilesY; y++ {
+			for x := 0; x < tilesX; x++ {
+				cells = append(cells, image.Pt(x, y))
+			}
+		}
+	}
+
+	bounds := image.Rect(0, 0, cols, rows)
+	tiles := make([]image.Rectangle, len(cells))
+	for i, c := range cells {
+		tiles[i] = image.Rect(c.X*size, c.Y*size, (c.X+1)*size, (c.Y+1)*size).Intersect(bounds)
+	}
+	return tiles
+}
+
+// Walks a square spiral around the center cell, skipping cells outside
+// the grid, until every cell has been visited.
+func spiralOrder(w, h int) []image.Point {
+	cells := make([]image.Point, 0, w*h)
+	p := image.Pt((w-1)/2, (h-1)/2)
+	directions := [4]image.Point{{1, 0}, {0, 1}, {-1, 0}, {0, -1}}
+	visit := func() {
+		if p.X >= 0 && p.X < w && p.Y >= 0 && p.Y < h {
+			cells = append(cells, p)
+		}
+	}
+
+	visit()
+	for length, d := 1, 0; len(cells) < w*h; length++ {
+		// Every length is walked twice: right then down, left then up.
+		for turn := 0; turn < 2; turn++ {
+			for i := 0; i < length; i++ {
+				p = p.Add(directions[d])
+				visit()
+			}
+			d = (d + 1) % 4
+		}
+	}
+	return cells
+}
+
+func hilbertOrder(w, h int) []image.Point {
+	n := 1
+	for n < w || n < h {
+		n *= 2
+	}
+
+	cells := make([]image.Point, 0, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			cells = append(cells, image.Pt(x, y))
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		return hilbertIndex(n, cells[i]) < hilbertIndex(n, cells[j])
+	})
+	return cells
+}
+
+// The distance along the Hilbert curve filling an n by n grid, n being a
+// power of two.
+func hilbertIndex(n int, p image.Point) int {
+	d := 0
+	x, y := p.X, p.Y
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry int
+		if x&s != 0 {
+			rx = 1
+		}
+		if y&s != 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		// Rotate the quadrant
+		if ry == 0 {
+			if rx == 1 {
+				x, y = n-1-x, n-1-y
+			}
+			x, y = y, x
+		}
+	}
+	return d
+}
+
+// A double ended queue of tiles belonging to one worker. The owner takes
+// tiles from the front while idle workers steal from the back.
+type tileQueue struct {
+	sync.Mutex
+	tiles []tile
+}
+
+func (q *tileQueue) pop() (tile, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.tiles) == 0 {
+		return tile{}, false
+	}
+	t := q.tiles[0]
+	q.tiles = q.tiles[1:]
+	return t, true
+}
+
+func (q *tileQueue) steal() (tile, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.tiles) == 0 {
+		return tile{}, false
+	}
+	t := q.tiles[len(q.tiles)-1]
+	q.tiles = q.tiles[:len(q.tiles)-1]
+	return t, true
+}
+
+// Deals the tiles out to one queue per worker round robin, so every
+// worker starts near the front of the tile order.
+func newTileQueues(tiles []image.Rectangle, workers int, rand *rand.Rand) []*tileQueue {
+	queues := make([]*tileQueue, workers)
+	for i := range queues {
+		queues[i] = &tileQueue{}
+	}
+	for i, bounds := range tiles {
+		q := queues[i%workers]
+		q.tiles = append(q.tiles, tile{bounds, rand.Int63(), i})
+	}
+	return queues
+}
+
+// Returns the next tile for the worker owning queues[own], stealing from
+// the other workers once its own queue is empty. Returns false when no
+// work is left.
+func nextTile(queues []*tileQueue, own int) (tile, bool) {
+	if t, ok := queues[own].pop(); ok {
+		return t, true
+	}
+	for i := 1; i < len(queues); i++ {
+		if t, ok := queues[(own+i)%len(queues)].steal(); ok {
+			return t, true
+		}
+	}
+	return tile{}, false
+}